@@ -0,0 +1,304 @@
+// Copyright 2018-2020 opcua authors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+
+package opcua
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gopcua/opcua/ua"
+)
+
+// VariableReadFunc produces the current Value attribute of a Variable
+// node on demand, e.g. to sample a live sensor reading.
+type VariableReadFunc func() (*ua.Variant, error)
+
+// MethodFunc implements the callable behavior of a Method node.
+type MethodFunc func(inputs []*ua.Variant) ([]*ua.Variant, ua.StatusCode)
+
+// node is the internal representation of every NodeClass the
+// AddressSpace knows how to serve.
+type node struct {
+	id         *ua.NodeID
+	class      ua.NodeClass
+	browseName *ua.QualifiedName
+	dataType   *ua.NodeID
+	access     ua.AccessLevelType
+
+	read VariableReadFunc
+	call MethodFunc
+	refs []*ua.ReferenceDescription
+}
+
+// AddressSpace is an in-memory NodeManager: the set of nodes a Server
+// exposes to Browse/Read/Write/TranslateBrowsePathsToNodeIds/Call.
+// The zero value is not usable; use NewAddressSpace.
+type AddressSpace struct {
+	mu    sync.RWMutex
+	nodes map[string]*node
+}
+
+// NewAddressSpace returns an AddressSpace seeded with the mandatory
+// Server object (i=2253) and its well-known children, so that a stock
+// client can browse a Server with nothing else registered.
+func NewAddressSpace() *AddressSpace {
+	as := &AddressSpace{nodes: make(map[string]*node)}
+	as.addServerObject()
+	return as
+}
+
+func (as *AddressSpace) key(id *ua.NodeID) string {
+	return id.String()
+}
+
+// AddObject registers an Object node under nodeID with the given browse
+// name, and adds a HasComponent reference from parentID to it.
+func (as *AddressSpace) AddObject(nodeID *ua.NodeID, browseName string, parentID *ua.NodeID) {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+
+	as.nodes[as.key(nodeID)] = &node{
+		id:         nodeID,
+		class:      ua.NodeClassObject,
+		browseName: &ua.QualifiedName{Name: browseName},
+	}
+	as.addReferenceLocked(parentID, nodeID, ua.ReferenceTypeIDHasComponent)
+}
+
+// AddVariable registers a Variable node under nodeID whose Value
+// attribute is produced by read on every ReadRequest.
+func (as *AddressSpace) AddVariable(nodeID *ua.NodeID, browseName string, dataType *ua.NodeID, parentID *ua.NodeID, read VariableReadFunc) {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+
+	as.nodes[as.key(nodeID)] = &node{
+		id:         nodeID,
+		class:      ua.NodeClassVariable,
+		browseName: &ua.QualifiedName{Name: browseName},
+		dataType:   dataType,
+		access:     ua.AccessLevelTypeCurrentRead,
+		read:       read,
+	}
+	as.addReferenceLocked(parentID, nodeID, ua.ReferenceTypeIDHasComponent)
+}
+
+// AddMethod registers a Method node under nodeID, callable via
+// CallRequest.
+func (as *AddressSpace) AddMethod(nodeID *ua.NodeID, browseName string, parentID *ua.NodeID, call MethodFunc) {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+
+	as.nodes[as.key(nodeID)] = &node{
+		id:         nodeID,
+		class:      ua.NodeClassMethod,
+		browseName: &ua.QualifiedName{Name: browseName},
+		call:       call,
+	}
+	as.addReferenceLocked(parentID, nodeID, ua.ReferenceTypeIDHasComponent)
+}
+
+// AddReference records a reference of refTypeID from srcID to dstID,
+// surfaced by future BrowseRequests against srcID.
+func (as *AddressSpace) AddReference(srcID, dstID *ua.NodeID, refTypeID *ua.NodeID) {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	as.addReferenceLocked(srcID, dstID, refTypeID)
+}
+
+func (as *AddressSpace) addReferenceLocked(srcID, dstID *ua.NodeID, refTypeID *ua.NodeID) {
+	if srcID == nil {
+		return
+	}
+	src, ok := as.nodes[as.key(srcID)]
+	if !ok {
+		return
+	}
+	dst := as.nodes[as.key(dstID)]
+	var dstClass ua.NodeClass
+	var browseName *ua.QualifiedName
+	if dst != nil {
+		dstClass = dst.class
+		browseName = dst.browseName
+	}
+	src.refs = append(src.refs, &ua.ReferenceDescription{
+		ReferenceTypeID: refTypeID,
+		IsForward:       true,
+		NodeID:          ua.NewExpandedNodeID(dstID),
+		BrowseName:      browseName,
+		NodeClass:       dstClass,
+	})
+}
+
+// browse returns the references held by the node identified by id.
+func (as *AddressSpace) browse(id *ua.NodeID) ([]*ua.ReferenceDescription, ua.StatusCode) {
+	as.mu.RLock()
+	defer as.mu.RUnlock()
+
+	n, ok := as.nodes[as.key(id)]
+	if !ok {
+		return nil, ua.StatusBadNodeIDUnknown
+	}
+	return n.refs, ua.StatusOK
+}
+
+// readAttribute returns the value of attrID on the node identified by
+// id, per the AttributeId table in OPC UA Part 4, 7.30.
+func (as *AddressSpace) readAttribute(id *ua.NodeID, attrID ua.AttributeID) (*ua.Variant, ua.StatusCode) {
+	as.mu.RLock()
+	n, ok := as.nodes[as.key(id)]
+	as.mu.RUnlock()
+	if !ok {
+		return nil, ua.StatusBadNodeIDUnknown
+	}
+
+	switch attrID {
+	case ua.AttributeIDNodeID:
+		return mustVariant(n.id), ua.StatusOK
+	case ua.AttributeIDNodeClass:
+		return mustVariant(int32(n.class)), ua.StatusOK
+	case ua.AttributeIDBrowseName:
+		return mustVariant(n.browseName), ua.StatusOK
+	case ua.AttributeIDDataType:
+		if n.class != ua.NodeClassVariable {
+			return nil, ua.StatusBadAttributeIDInvalid
+		}
+		return mustVariant(n.dataType), ua.StatusOK
+	case ua.AttributeIDAccessLevel, ua.AttributeIDUserAccessLevel:
+		if n.class != ua.NodeClassVariable {
+			return nil, ua.StatusBadAttributeIDInvalid
+		}
+		return mustVariant(byte(n.access)), ua.StatusOK
+	case ua.AttributeIDValue:
+		if n.class != ua.NodeClassVariable {
+			return nil, ua.StatusBadAttributeIDInvalid
+		}
+		if n.read == nil {
+			return nil, ua.StatusBadAttributeIDInvalid
+		}
+		v, err := n.read()
+		if err != nil {
+			return nil, ua.StatusBadInternalError
+		}
+		return v, ua.StatusOK
+	default:
+		return nil, ua.StatusBadAttributeIDInvalid
+	}
+}
+
+// writeValue services a write of attrID on the node identified by id.
+// AddVariable only registers computed, read-only variables, so every
+// write is rejected: BadNodeIDUnknown for an unknown node,
+// BadAttributeIDInvalid for anything but a Variable's Value, and
+// BadNotWritable otherwise.
+func (as *AddressSpace) writeValue(id *ua.NodeID, attrID ua.AttributeID, v *ua.Variant) ua.StatusCode {
+	as.mu.RLock()
+	n, ok := as.nodes[as.key(id)]
+	as.mu.RUnlock()
+	if !ok {
+		return ua.StatusBadNodeIDUnknown
+	}
+	if n.class != ua.NodeClassVariable || attrID != ua.AttributeIDValue {
+		return ua.StatusBadAttributeIDInvalid
+	}
+	return ua.StatusBadNotWritable
+}
+
+// translateBrowsePath resolves a BrowsePath (a starting node plus a
+// RelativePath of target browse names) to the NodeID it names, walking
+// one hop per RelativePath element along the first reference whose
+// target's browse name matches the element's TargetName.Name. The
+// reference type and the browse name's namespace are not checked.
+func (as *AddressSpace) translateBrowsePath(bp *ua.BrowsePath) (*ua.NodeID, ua.StatusCode) {
+	cur := bp.StartingNode
+	for _, elem := range bp.RelativePath.Elements {
+		refs, status := as.browse(cur)
+		if status != ua.StatusOK {
+			return nil, status
+		}
+
+		var next *ua.NodeID
+		for _, ref := range refs {
+			if ref.BrowseName != nil && ref.BrowseName.Name == elem.TargetName.Name {
+				next = ref.NodeID.NodeID
+				break
+			}
+		}
+		if next == nil {
+			return nil, ua.StatusBadNoMatch
+		}
+		cur = next
+	}
+	return cur, ua.StatusOK
+}
+
+// call invokes the Method identified by id with the given inputs.
+func (as *AddressSpace) call(id *ua.NodeID, inputs []*ua.Variant) ([]*ua.Variant, ua.StatusCode) {
+	as.mu.RLock()
+	n, ok := as.nodes[as.key(id)]
+	as.mu.RUnlock()
+	if !ok {
+		return nil, ua.StatusBadNodeIDUnknown
+	}
+	if n.class != ua.NodeClassMethod || n.call == nil {
+		return nil, ua.StatusBadNotExecutable
+	}
+	return n.call(inputs)
+}
+
+// addServerObject seeds the mandatory Server object (i=2253) and the
+// handful of its children a client expects to find when it browses it:
+// ServerStatus, CurrentTime, and NamespaceArray.
+func (as *AddressSpace) addServerObject() {
+	serverID := ua.NewNumericNodeID(0, 2253)
+	as.nodes[as.key(serverID)] = &node{
+		id:         serverID,
+		class:      ua.NodeClassObject,
+		browseName: &ua.QualifiedName{Name: "Server"},
+	}
+
+	namespaceArrayID := ua.NewNumericNodeID(0, 2255)
+	as.nodes[as.key(namespaceArrayID)] = &node{
+		id:         namespaceArrayID,
+		class:      ua.NodeClassVariable,
+		browseName: &ua.QualifiedName{Name: "NamespaceArray"},
+		access:     ua.AccessLevelTypeCurrentRead,
+		read: func() (*ua.Variant, error) {
+			return mustVariant([]string{"http://opcfoundation.org/UA/"}), nil
+		},
+	}
+	as.addReferenceLocked(serverID, namespaceArrayID, ua.ReferenceTypeIDHasComponent)
+
+	currentTimeID := ua.NewNumericNodeID(0, 2258)
+	as.nodes[as.key(currentTimeID)] = &node{
+		id:         currentTimeID,
+		class:      ua.NodeClassVariable,
+		browseName: &ua.QualifiedName{Name: "CurrentTime"},
+		access:     ua.AccessLevelTypeCurrentRead,
+		read: func() (*ua.Variant, error) {
+			return mustVariant(time.Now().UTC()), nil
+		},
+	}
+	as.addReferenceLocked(serverID, currentTimeID, ua.ReferenceTypeIDHasComponent)
+
+	serverStatusID := ua.NewNumericNodeID(0, 2256)
+	as.nodes[as.key(serverStatusID)] = &node{
+		id:         serverStatusID,
+		class:      ua.NodeClassVariable,
+		browseName: &ua.QualifiedName{Name: "ServerStatus"},
+		access:     ua.AccessLevelTypeCurrentRead,
+		read: func() (*ua.Variant, error) {
+			return mustVariant(&ua.ServerStatusDataType{State: ua.ServerStateRunning}), nil
+		},
+	}
+	as.addReferenceLocked(serverID, serverStatusID, ua.ReferenceTypeIDHasComponent)
+}
+
+func mustVariant(v interface{}) *ua.Variant {
+	variant, err := ua.NewVariant(v)
+	if err != nil {
+		return &ua.Variant{}
+	}
+	return variant
+}
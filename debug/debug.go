@@ -0,0 +1,26 @@
+// Copyright 2018-2020 opcua authors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+
+// Package debug is kept for backward compatibility with code written
+// against the unstructured Printf-style logging gopcua used before the
+// opcua.Logger interface existed. New code should use opcua.WithLogger
+// instead; Printf here just forwards to a package-level sink so existing
+// callers keep working.
+package debug
+
+import "fmt"
+
+// Sink receives every message passed to Printf. It defaults to discarding
+// everything; set it to forward debug output into a structured Logger,
+// e.g. from opcua.WithLogger's implementation.
+var Sink func(msg string)
+
+// Printf formats according to a format specifier and passes the result to
+// Sink, if one is set.
+func Printf(format string, args ...interface{}) {
+	if Sink == nil {
+		return
+	}
+	Sink(fmt.Sprintf(format, args...))
+}
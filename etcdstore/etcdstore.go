@@ -0,0 +1,331 @@
+// Copyright 2018-2020 opcua authors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+
+// Package etcdstore implements opcua.Store on top of etcd v3, so a fleet
+// of gopcua servers behind a load balancer can share session and
+// subscription state and survive an individual instance restarting.
+// Session keys are held under an etcd lease matching the session's
+// timeout, so a crashed instance's sessions expire on their own; moving
+// a subscription between instances during failover is done with a
+// single etcd transaction so exactly one instance ever believes it owns
+// it.
+package etcdstore
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+
+	"github.com/gopcua/opcua"
+	"github.com/gopcua/opcua/ua"
+)
+
+const (
+	sessionPrefix      = "/gopcua/sessions/"
+	subscriptionPrefix = "/gopcua/subscriptions/"
+)
+
+// minLeaseTTLSeconds floors the TTL a session's etcd lease is granted
+// with: etcd rejects a lease grant of 0, which int64(Timeout.Seconds())
+// would otherwise request for any sub-second SessionTimeout.
+const minLeaseTTLSeconds = 1
+
+// Store is an opcua.Store backed by an etcd v3 cluster.
+type Store struct {
+	cli *clientv3.Client
+	ctx context.Context
+
+	mu     sync.Mutex
+	leases map[string]clientv3.LeaseID
+
+	events chan opcua.StoreEvent
+}
+
+// New returns a Store using cli. ctx bounds the background watch
+// started on cli; cancelling it closes the channel returned by Watch.
+func New(ctx context.Context, cli *clientv3.Client) *Store {
+	st := &Store{
+		cli:    cli,
+		ctx:    ctx,
+		leases: make(map[string]clientv3.LeaseID),
+		events: make(chan opcua.StoreEvent),
+	}
+	go st.watch()
+	return st
+}
+
+// sessionRecord is the JSON-safe projection of opcua.Session stored in
+// etcd; opcua.Session itself carries unexported bookkeeping fields that
+// have no business surviving a round-trip through another process.
+type sessionRecord struct {
+	ID                  string    `json:"id"`
+	AuthenticationToken string    `json:"authentication_token"`
+	TimeoutSeconds      float64   `json:"timeout_seconds"`
+	ClientCertificate   []byte    `json:"client_certificate,omitempty"`
+	ServerNonce         []byte    `json:"server_nonce,omitempty"`
+	Activated           bool      `json:"activated"`
+	Deadline            time.Time `json:"deadline"`
+}
+
+// subscriptionRecord is the JSON-safe projection of opcua.Subscription
+// stored in etcd: its ID and publishing parameters only. Its Owner,
+// MonitoredItems, retransmission queue and in-flight PublishRequests are
+// not stored.
+type subscriptionRecord struct {
+	ID                        uint32  `json:"id"`
+	PublishingIntervalSeconds float64 `json:"publishing_interval_seconds"`
+	MaxKeepAliveCount         uint32  `json:"max_keep_alive_count"`
+	LifetimeCount             uint32  `json:"lifetime_count"`
+}
+
+func (st *Store) PutSession(token string, sess *opcua.Session) error {
+	rec := sessionRecord{
+		ID:                  sess.ID.String(),
+		AuthenticationToken: sess.AuthenticationToken.String(),
+		TimeoutSeconds:      sess.Timeout.Seconds(),
+		ClientCertificate:   sess.ClientCertificate,
+		ServerNonce:         sess.ServerNonce,
+		Activated:           sess.Activated,
+		Deadline:            sess.Deadline,
+	}
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	leaseID, err := st.sessionLease(token, sess.Timeout)
+	if err != nil {
+		return err
+	}
+
+	_, err = st.cli.Put(st.ctx, sessionPrefix+token, string(b), clientv3.WithLease(leaseID))
+	return err
+}
+
+// sessionLease returns the etcd lease backing token's key: a fresh one
+// is Granted the first time token is seen, and KeepAlive'd (rather than
+// replaced with another Grant) on every later call. SessionManager.Get
+// and Activate call PutSession on every request to refresh the session's
+// deadline, and a Grant per call would leak one never-revoked lease per
+// request.
+func (st *Store) sessionLease(token string, timeout time.Duration) (clientv3.LeaseID, error) {
+	ttl := int64(timeout.Seconds())
+	if ttl < minLeaseTTLSeconds {
+		ttl = minLeaseTTLSeconds
+	}
+
+	st.mu.Lock()
+	leaseID, ok := st.leases[token]
+	st.mu.Unlock()
+
+	if ok {
+		if _, err := st.cli.KeepAliveOnce(st.ctx, leaseID); err == nil {
+			return leaseID, nil
+		}
+		// The lease expired or was revoked out from under us; fall
+		// through and grant a replacement.
+	}
+
+	lease, err := st.cli.Grant(st.ctx, ttl)
+	if err != nil {
+		return 0, fmt.Errorf("etcdstore: grant lease: %w", err)
+	}
+
+	st.mu.Lock()
+	st.leases[token] = lease.ID
+	st.mu.Unlock()
+	return lease.ID, nil
+}
+
+func (st *Store) GetSession(token string) (*opcua.Session, error) {
+	resp, err := st.cli.Get(st.ctx, sessionPrefix+token)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, fmt.Errorf("etcdstore: session %q not found", token)
+	}
+
+	var rec sessionRecord
+	if err := json.Unmarshal(resp.Kvs[0].Value, &rec); err != nil {
+		return nil, err
+	}
+	return recordToSession(rec), nil
+}
+
+func (st *Store) DeleteSession(token string) error {
+	st.mu.Lock()
+	leaseID, ok := st.leases[token]
+	delete(st.leases, token)
+	st.mu.Unlock()
+
+	if ok {
+		_, _ = st.cli.Revoke(st.ctx, leaseID)
+	}
+
+	_, err := st.cli.Delete(st.ctx, sessionPrefix+token)
+	return err
+}
+
+func (st *Store) ListSessions() ([]*opcua.Session, error) {
+	resp, err := st.cli.Get(st.ctx, sessionPrefix, clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]*opcua.Session, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		var rec sessionRecord
+		if err := json.Unmarshal(kv.Value, &rec); err != nil {
+			return nil, err
+		}
+		out = append(out, recordToSession(rec))
+	}
+	return out, nil
+}
+
+func (st *Store) PutSubscription(id uint32, sub *opcua.Subscription) error {
+	rec := subscriptionRecord{
+		ID:                        sub.ID,
+		PublishingIntervalSeconds: sub.PublishingInterval.Seconds(),
+		MaxKeepAliveCount:         sub.MaxKeepAliveCount,
+		LifetimeCount:             sub.LifetimeCount,
+	}
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	_, err = st.cli.Put(st.ctx, st.subscriptionKey(id), string(b))
+	return err
+}
+
+func (st *Store) GetSubscription(id uint32) (*opcua.Subscription, error) {
+	resp, err := st.cli.Get(st.ctx, st.subscriptionKey(id))
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, fmt.Errorf("etcdstore: subscription %d not found", id)
+	}
+
+	var rec subscriptionRecord
+	if err := json.Unmarshal(resp.Kvs[0].Value, &rec); err != nil {
+		return nil, err
+	}
+	return recordToSubscription(rec), nil
+}
+
+func (st *Store) DeleteSubscription(id uint32) error {
+	_, err := st.cli.Delete(st.ctx, st.subscriptionKey(id))
+	return err
+}
+
+func (st *Store) ListSubscriptions() ([]*opcua.Subscription, error) {
+	resp, err := st.cli.Get(st.ctx, subscriptionPrefix, clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]*opcua.Subscription, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		var rec subscriptionRecord
+		if err := json.Unmarshal(kv.Value, &rec); err != nil {
+			return nil, err
+		}
+		out = append(out, recordToSubscription(rec))
+	}
+	return out, nil
+}
+
+// TransferSubscription moves ownership of subscription id from this
+// instance to newOwner atomically: the write only succeeds if the
+// subscription's owner key still matches this instance's previous
+// value, so two instances racing a failover can't both believe they
+// took it over.
+func (st *Store) TransferSubscription(id uint32, prevOwner, newOwner string) error {
+	key := st.subscriptionKey(id) + "/owner"
+	txn := st.cli.Txn(st.ctx).
+		If(clientv3.Compare(clientv3.Value(key), "=", prevOwner)).
+		Then(clientv3.OpPut(key, newOwner))
+
+	resp, err := txn.Commit()
+	if err != nil {
+		return err
+	}
+	if !resp.Succeeded {
+		return fmt.Errorf("etcdstore: subscription %d is no longer owned by %q", id, prevOwner)
+	}
+	return nil
+}
+
+// recordToSession rebuilds the fields of opcua.Session that actually
+// cross a process boundary, including Activated and Deadline: without
+// them, a session taken over mid-Publish by another instance would look
+// not-yet-activated and already expired to SessionManager.Get, which
+// deletes it on the very next request.
+func recordToSession(rec sessionRecord) *opcua.Session {
+	id, _ := ua.ParseNodeID(rec.ID)
+	token, _ := ua.ParseNodeID(rec.AuthenticationToken)
+	return &opcua.Session{
+		ID:                  id,
+		AuthenticationToken: token,
+		Timeout:             time.Duration(rec.TimeoutSeconds * float64(time.Second)),
+		ClientCertificate:   rec.ClientCertificate,
+		ServerNonce:         rec.ServerNonce,
+		Activated:           rec.Activated,
+		Deadline:            rec.Deadline,
+	}
+}
+
+func recordToSubscription(rec subscriptionRecord) *opcua.Subscription {
+	return &opcua.Subscription{
+		ID:                 rec.ID,
+		PublishingInterval: time.Duration(rec.PublishingIntervalSeconds * float64(time.Second)),
+		MaxKeepAliveCount:  rec.MaxKeepAliveCount,
+		LifetimeCount:      rec.LifetimeCount,
+	}
+}
+
+func (st *Store) subscriptionKey(id uint32) string {
+	return fmt.Sprintf("%s%d", subscriptionPrefix, id)
+}
+
+// Watch returns the channel of events for every change under the
+// /gopcua/ prefix of the etcd cluster, including changes this Store
+// made itself.
+func (st *Store) Watch() <-chan opcua.StoreEvent {
+	return st.events
+}
+
+func (st *Store) watch() {
+	defer close(st.events)
+
+	wch := st.cli.Watch(st.ctx, "/gopcua/", clientv3.WithPrefix())
+	for resp := range wch {
+		for _, ev := range resp.Events {
+			kind := opcua.EventSessionPut
+			key := string(ev.Kv.Key)
+			switch {
+			case ev.Type == clientv3.EventTypeDelete && len(key) > len(sessionPrefix) && key[:len(sessionPrefix)] == sessionPrefix:
+				kind = opcua.EventSessionDeleted
+			case len(key) > len(sessionPrefix) && key[:len(sessionPrefix)] == sessionPrefix:
+				kind = opcua.EventSessionPut
+			case ev.Type == clientv3.EventTypeDelete:
+				kind = opcua.EventSubscriptionDeleted
+			default:
+				kind = opcua.EventSubscriptionPut
+			}
+
+			select {
+			case st.events <- opcua.StoreEvent{Kind: kind, Key: key}:
+			case <-st.ctx.Done():
+				return
+			}
+		}
+	}
+}
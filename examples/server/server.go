@@ -20,7 +20,7 @@ func main() {
 	ctx := context.Background()
 
 	s := opcua.NewServer(*endpoint)
-	h := opcua.HandlerFunc(func(w opcua.ResponseWriter, r *opcua.Request) {
+	h := opcua.HandlerFunc(func(w *opcua.ResponseWriter, r *opcua.Request) {
 		fmt.Println(r)
 	})
 
@@ -0,0 +1,62 @@
+// Copyright 2018-2020 opcua authors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+
+package opcua
+
+import (
+	"github.com/gopcua/opcua/debug"
+	"github.com/gopcua/opcua/uasc"
+)
+
+// Logger is the structured logging interface accepted by WithLogger. Log
+// takes a level, a message and an even-length list of alternating key/value
+// pairs, e.g. Log(LogLevelDebug, "recv", "conn_id", connID, "service", "Read").
+type Logger interface {
+	Log(level LogLevel, msg string, kv ...interface{})
+}
+
+// LogLevel selects the severity passed to Logger.Log.
+type LogLevel int
+
+const (
+	LogLevelDebug LogLevel = iota
+	LogLevelInfo
+	LogLevelWarn
+	LogLevelError
+)
+
+func (l LogLevel) String() string {
+	switch l {
+	case LogLevelDebug:
+		return "debug"
+	case LogLevelInfo:
+		return "info"
+	case LogLevelWarn:
+		return "warn"
+	case LogLevelError:
+		return "error"
+	default:
+		return "unknown"
+	}
+}
+
+// noopLogger is the default Logger: it discards everything. Servers and
+// Clients that don't call WithLogger pay no logging overhead beyond the
+// interface dispatch.
+type noopLogger struct{}
+
+func (noopLogger) Log(LogLevel, string, ...interface{}) {}
+
+// DefaultLogger is the Logger used when no WithLogger option is given.
+var DefaultLogger Logger = noopLogger{}
+
+// WithLogger sets the Logger a Client or Server reports through. It also
+// points package debug's Sink at l, so the legacy debug.Printf callers
+// still scattered through uacp/uasc stop being silently discarded.
+func WithLogger(l Logger) Option {
+	return func(c *uasc.Config, _ *uasc.SessionConfig) {
+		c.Logger = l
+		debug.Sink = func(msg string) { l.Log(LogLevelDebug, msg) }
+	}
+}
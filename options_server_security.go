@@ -0,0 +1,47 @@
+// Copyright 2018-2020 opcua authors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+
+package opcua
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+
+	"github.com/gopcua/opcua/uasc"
+)
+
+// WithServerCertificate sets the certificate the server presents during
+// the secure-channel handshake, in DER form. It is required for every
+// SecurityPolicy other than None.
+func WithServerCertificate(cert []byte) Option {
+	return func(c *uasc.Config, _ *uasc.SessionConfig) {
+		c.Certificate = cert
+	}
+}
+
+// WithServerKey sets the private key matching the certificate passed to
+// WithServerCertificate, used to sign/decrypt the secure-channel
+// handshake and to derive symmetric keys.
+func WithServerKey(key *rsa.PrivateKey) Option {
+	return func(c *uasc.Config, _ *uasc.SessionConfig) {
+		c.PrivateKey = key
+	}
+}
+
+// WithTrustedCertificates sets the client certificates this server
+// accepts for any SecurityPolicy other than None.
+func WithTrustedCertificates(certs []*x509.Certificate) Option {
+	return func(c *uasc.Config, _ *uasc.SessionConfig) {
+		c.TrustedCertificates = certs
+	}
+}
+
+// WithEnabledSecurityPolicies sets the SecurityPolicy URIs this server
+// negotiates, in the order it prefers them. The default is
+// SecurityPolicy#None only.
+func WithEnabledSecurityPolicies(uris []string) Option {
+	return func(c *uasc.Config, _ *uasc.SessionConfig) {
+		c.EnabledSecurityPolicies = uris
+	}
+}
@@ -6,8 +6,9 @@ package opcua
 
 import (
 	"context"
+	"fmt"
+	"reflect"
 
-	"github.com/gopcua/opcua/debug"
 	"github.com/gopcua/opcua/ua"
 	"github.com/gopcua/opcua/uacp"
 	"github.com/gopcua/opcua/uasc"
@@ -33,15 +34,41 @@ type Server struct {
 
 	// sessionCfg is the configuration for the session.
 	sessionCfg *uasc.SessionConfig
+
+	// sessionMgr tracks the sessions created by clients of this server.
+	sessionMgr *SessionManager
+
+	// addrSpace holds the nodes this server exposes to
+	// Browse/Read/Write/Call. Access it via Server.AddressSpace.
+	addrSpace *AddressSpace
+
+	// subMgr tracks the Subscriptions created by clients of this
+	// server. Access it via Server.SubscriptionManager.
+	subMgr *SubscriptionManager
+
+	// store persists sessions and subscriptions; set via WithStore.
+	// Defaults to a process-local MemStore.
+	store Store
 }
 
 func NewServer(endpoint string, opts ...Option) *Server {
 	cfg, sessionCfg := ApplyConfig(DefaultServerConfig(), DefaultServerSessionConfig(), opts...)
-	return &Server{
+
+	store := cfg.Store
+	if store == nil {
+		store = NewMemStore()
+	}
+
+	s := &Server{
 		endpointURL: endpoint,
 		cfg:         cfg,
 		sessionCfg:  sessionCfg,
+		store:       store,
+		sessionMgr:  NewSessionManager(sessionCfg.MaxSessionCount, store),
+		addrSpace:   NewAddressSpace(),
 	}
+	s.subMgr = NewSubscriptionManager(s.addrSpace, store, s.logger())
+	return s
 }
 
 func (s *Server) ListenAndServe(ctx context.Context, h Handler) error {
@@ -57,7 +84,6 @@ func (s *Server) ListenAndServe(ctx context.Context, h Handler) error {
 		return err
 	}
 	s.l = l
-	s.cfg = DefaultServerConfig()
 	return s.serve(ctx, h)
 }
 
@@ -69,8 +95,10 @@ func (s *Server) serve(ctx context.Context, h Handler) error {
 			return err
 		}
 
-		// establish secure channel
-		sechan, err := uasc.NewSecureChannel(s.endpointURL, c, s.cfg)
+		// establish secure channel, negotiating SecurityPolicy/Mode and
+		// verifying the client certificate as configured via
+		// WithServerCertificate/WithServerKey/WithTrustedCertificates.
+		sechan, err := uasc.NewServerSecureChannel(s.endpointURL, c, s.cfg)
 		if err != nil {
 			_ = c.Close()
 			return err
@@ -81,29 +109,207 @@ func (s *Server) serve(ctx context.Context, h Handler) error {
 	}
 }
 
+// logger returns the Logger configured via WithLogger, or DefaultLogger
+// (a no-op) if none was given.
+func (s *Server) logger() Logger {
+	if s.cfg != nil && s.cfg.Logger != nil {
+		return s.cfg.Logger
+	}
+	return DefaultLogger
+}
+
+// logRequest logs msg at LogLevelDebug with the conn_id, channel_id,
+// token_id, request_handle, and service keys every request handler
+// cares about, plus any extra kv.
+func (s *Server) logRequest(connID uint32, sechan *uasc.SecureChannel, msg string, v interface{}, kv ...interface{}) {
+	tokenID := ""
+	if token := sechan.AuthenticationToken(); token != nil {
+		tokenID = token.String()
+	}
+	base := []interface{}{
+		"conn_id", connID,
+		"channel_id", sechan.ID(),
+		"token_id", tokenID,
+		"request_handle", requestHandle(v),
+		"service", fmt.Sprintf("%T", v),
+	}
+	s.logger().Log(LogLevelDebug, msg, append(base, kv...)...)
+}
+
+// requestHandle extracts RequestHeader.RequestHandle from v by
+// reflection: every ua.*Request type embeds a *ua.RequestHeader, but
+// there's no common interface to type-assert against across the dozens
+// of request types logRequest is called with.
+func requestHandle(v interface{}) uint32 {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return 0
+	}
+	f := rv.Elem().FieldByName("RequestHeader")
+	if !f.IsValid() || f.IsNil() {
+		return 0
+	}
+	h, ok := f.Interface().(*ua.RequestHeader)
+	if !ok || h == nil {
+		return 0
+	}
+	return h.RequestHandle
+}
+
+// publishResult is a Publish notification ready to be sent, produced by
+// a goroutine handlePublish spawned to wait for it without blocking
+// handle's receive loop.
+type publishResult struct {
+	req  *ua.PublishRequest
+	resp *ua.PublishResponse
+}
+
+// handle is the single goroutine reading requests off sechan and
+// dispatching them; it is also the only goroutine that ever calls
+// sechan.Send/SendResponse, so that concurrent writes (e.g. a Publish
+// notification completing while another request is being answered)
+// can't interleave on the wire. A request whose response isn't ready
+// synchronously, such as Publish, reports back on publishDone instead
+// of writing to sechan itself.
 func (s *Server) handle(ctx context.Context, connID uint32, sechan *uasc.SecureChannel) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	msgs := make(chan *uasc.Message)
+	go func() {
+		defer close(msgs)
+		for {
+			msg := sechan.Receive(ctx)
+			select {
+			case msgs <- msg:
+			case <-ctx.Done():
+				return
+			}
+			if msg.Err != nil {
+				return
+			}
+		}
+	}()
+
+	publishDone := make(chan publishResult, maxPendingPublish)
 	for {
-		msg := sechan.Receive(ctx)
-		if msg.Err != nil {
-			debug.Printf("conn %d: recv %#v", connID, msg.Err)
-			_ = sechan.Close()
+		select {
+		case <-ctx.Done():
+			return
+
+		case pr := <-publishDone:
+			if pr.resp != nil {
+				sechan.SendResponse(pr.req, pr.resp)
+			} else {
+				// The Subscription servicing this Publish was deleted
+				// while it was outstanding; Subscription.Close closes
+				// the channel rather than sending on it.
+				sechan.SendResponse(pr.req, serviceFault(ua.StatusBadNoSubscription))
+			}
+
+		case msg, ok := <-msgs:
+			if !ok {
+				return
+			}
+			if msg.Err != nil {
+				s.logger().Log(LogLevelError, "recv", "conn_id", connID, "error", msg.Err)
+				_ = sechan.Close()
+				return
+			}
+			s.logRequest(connID, sechan, "recv", msg.V)
+			s.dispatch(ctx, connID, sechan, msg, publishDone)
+		}
+	}
+}
+
+func (s *Server) dispatch(ctx context.Context, connID uint32, sechan *uasc.SecureChannel, msg *uasc.Message, publishDone chan<- publishResult) {
+	switch req := msg.V.(type) {
+	case *ua.OpenSecureChannelRequest:
+		s.handleRenewSecureChannel(connID, sechan, req)
+	case *ua.FindServersRequest:
+		s.handleFindServers(ctx, connID, sechan, req)
+	case *ua.GetEndpointsRequest:
+		s.handleGetEndpoints(ctx, connID, sechan, req)
+	case *ua.CreateSessionRequest:
+		s.handleCreateSession(ctx, connID, sechan, req)
+	case *ua.ActivateSessionRequest:
+		s.handleActivateSession(ctx, connID, sechan, req)
+	case *ua.CloseSessionRequest:
+		s.handleCloseSession(ctx, connID, sechan, req)
+	case *ua.CancelRequest:
+		s.handleCancel(ctx, connID, sechan, req)
+	case *ua.BrowseRequest, *ua.ReadRequest, *ua.WriteRequest, *ua.TranslateBrowsePathsToNodeIdsRequest, *ua.CallRequest,
+		*ua.CreateSubscriptionRequest, *ua.ModifySubscriptionRequest, *ua.DeleteSubscriptionsRequest, *ua.SetPublishingModeRequest,
+		*ua.CreateMonitoredItemsRequest, *ua.ModifyMonitoredItemsRequest, *ua.DeleteMonitoredItemsRequest,
+		*ua.PublishRequest, *ua.RepublishRequest:
+		// Every one of these services operates on AddressSpace/Subscription
+		// state scoped to an activated Session; reject them here rather
+		// than let each handler repeat the same check.
+		if _, err := s.sessionMgr.Get(sechan.AuthenticationToken()); err != nil {
+			s.logRequest(connID, sechan, "no active session", req, "error", err)
+			sechan.SendResponse(req, serviceFault(err))
 			return
 		}
-		debug.Printf("conn %d: recv %#v", connID, msg)
-
-		switch req := msg.V.(type) {
-		case *ua.FindServersRequest:
-			s.handleFindServers(ctx, connID, sechan, req)
-		case *ua.GetEndpointsRequest:
-			s.handleGetEndpoints(ctx, connID, sechan, req)
-		default:
-			debug.Printf("conn %d: cannot handle %T", connID, req)
+		s.dispatchAuthenticated(ctx, connID, sechan, req, publishDone)
+	default:
+		sess, err := s.sessionMgr.Get(sechan.AuthenticationToken())
+		if err != nil {
+			s.logRequest(connID, sechan, "no active session", req, "error", err)
+			return
 		}
+		s.serveRequest(connID, sechan, sess, msg)
+	}
+}
+
+// dispatchAuthenticated routes req to its handler once dispatch has
+// confirmed sechan's AuthenticationToken names an activated Session.
+func (s *Server) dispatchAuthenticated(ctx context.Context, connID uint32, sechan *uasc.SecureChannel, req interface{}, publishDone chan<- publishResult) {
+	switch req := req.(type) {
+	case *ua.BrowseRequest:
+		s.handleBrowse(ctx, connID, sechan, req)
+	case *ua.ReadRequest:
+		s.handleRead(ctx, connID, sechan, req)
+	case *ua.WriteRequest:
+		s.handleWrite(ctx, connID, sechan, req)
+	case *ua.TranslateBrowsePathsToNodeIdsRequest:
+		s.handleTranslateBrowsePaths(ctx, connID, sechan, req)
+	case *ua.CallRequest:
+		s.handleCall(ctx, connID, sechan, req)
+	case *ua.CreateSubscriptionRequest:
+		s.handleCreateSubscription(ctx, connID, sechan, req)
+	case *ua.ModifySubscriptionRequest:
+		s.handleModifySubscription(ctx, connID, sechan, req)
+	case *ua.DeleteSubscriptionsRequest:
+		s.handleDeleteSubscriptions(ctx, connID, sechan, req)
+	case *ua.SetPublishingModeRequest:
+		s.handleSetPublishingMode(ctx, connID, sechan, req)
+	case *ua.CreateMonitoredItemsRequest:
+		s.handleCreateMonitoredItems(ctx, connID, sechan, req)
+	case *ua.ModifyMonitoredItemsRequest:
+		s.handleModifyMonitoredItems(ctx, connID, sechan, req)
+	case *ua.DeleteMonitoredItemsRequest:
+		s.handleDeleteMonitoredItems(ctx, connID, sechan, req)
+	case *ua.PublishRequest:
+		s.handlePublish(ctx, connID, sechan, req, publishDone)
+	case *ua.RepublishRequest:
+		s.handleRepublish(ctx, connID, sechan, req)
+	}
+}
+
+// handleRenewSecureChannel services a renewal OpenSecureChannelRequest
+// on an already-established channel: like FindServers/GetEndpoints it
+// needs no session, so it is dispatched directly out of dispatch's
+// switch rather than through serveRequest.
+func (s *Server) handleRenewSecureChannel(connID uint32, sechan *uasc.SecureChannel, req *ua.OpenSecureChannelRequest) {
+	s.logRequest(connID, sechan, "handle", req)
+	if err := sechan.Renew(req, s.cfg.Certificate); err != nil {
+		s.logger().Log(LogLevelError, "renew secure channel", "conn_id", connID, "error", err)
+		_ = sechan.Close()
 	}
 }
 
 func (s *Server) handleFindServers(ctx context.Context, connID uint32, sechan *uasc.SecureChannel, req *ua.FindServersRequest) {
-	debug.Printf("conn %d: handle %T", connID, req)
+	s.logRequest(connID, sechan, "handle", req)
 	resp := &ua.FindServersResponse{
 		Servers: []*ua.ApplicationDescription{
 			&ua.ApplicationDescription{
@@ -122,49 +328,92 @@ func (s *Server) handleFindServers(ctx context.Context, connID uint32, sechan *u
 }
 
 func (s *Server) handleGetEndpoints(ctx context.Context, connID uint32, sechan *uasc.SecureChannel, req *ua.GetEndpointsRequest) {
-	debug.Printf("conn %d: handle %T", connID, req)
+	s.logRequest(connID, sechan, "handle", req)
 	resp := &ua.GetEndpointsResponse{
-		Endpoints: []*ua.EndpointDescription{
-			&ua.EndpointDescription{
-				EndpointURL: s.endpointURL,
-				Server: &ua.ApplicationDescription{
-					ApplicationURI:  s.sessionCfg.ClientDescription.ApplicationURI,
-					ProductURI:      s.sessionCfg.ClientDescription.ProductURI,
-					ApplicationName: s.sessionCfg.ClientDescription.ApplicationName,
-					ApplicationType: s.sessionCfg.ClientDescription.ApplicationType,
-					// GatewayServerURI    string
-					// DiscoveryProfileURI string
-					DiscoveryURLs: []string{s.endpointURL},
-				},
-				ServerCertificate:  nil,
-				SecurityMode:       s.cfg.SecurityMode,
-				SecurityPolicyURI:  s.cfg.SecurityPolicyURI,
-				UserIdentityTokens: []*ua.UserTokenPolicy{},
-				// TransportProfileURI string
-				// SecurityLevel: s.cfg.SecurityLevel,
-			},
-		},
+		Endpoints: s.endpoints(),
 	}
 
 	sechan.SendResponse(req, resp)
 }
 
+// endpoints returns the EndpointDescriptions this server advertises to
+// clients via FindServers/GetEndpoints and hands out in
+// CreateSessionResponse: one per policy in s.cfg.EnabledSecurityPolicies,
+// falling back to the single SecurityMode/SecurityPolicyURI the server
+// was constructed with if none were configured.
+func (s *Server) endpoints() []*ua.EndpointDescription {
+	app := &ua.ApplicationDescription{
+		ApplicationURI:  s.sessionCfg.ClientDescription.ApplicationURI,
+		ProductURI:      s.sessionCfg.ClientDescription.ProductURI,
+		ApplicationName: s.sessionCfg.ClientDescription.ApplicationName,
+		ApplicationType: s.sessionCfg.ClientDescription.ApplicationType,
+		// GatewayServerURI    string
+		// DiscoveryProfileURI string
+		DiscoveryURLs: []string{s.endpointURL},
+	}
+
+	policies := s.cfg.EnabledSecurityPolicies
+	if len(policies) == 0 {
+		policies = []string{s.cfg.SecurityPolicyURI}
+	}
+
+	eps := make([]*ua.EndpointDescription, 0, len(policies))
+	for _, policyURI := range policies {
+		mode := s.cfg.SecurityMode
+		if policyURI == uasc.SecurityPolicyURINone {
+			mode = ua.MessageSecurityModeNone
+		}
+		eps = append(eps, &ua.EndpointDescription{
+			EndpointURL:        s.endpointURL,
+			Server:             app,
+			ServerCertificate:  s.cfg.Certificate,
+			SecurityMode:       mode,
+			SecurityPolicyURI:  policyURI,
+			UserIdentityTokens: []*ua.UserTokenPolicy{},
+			// TransportProfileURI string
+			// SecurityLevel: s.cfg.SecurityLevel,
+		})
+	}
+	return eps
+}
+
+// serveRequest dispatches a request on an established session to the
+// user-provided Handler.
+func (s *Server) serveRequest(connID uint32, sechan *uasc.SecureChannel, sess *Session, msg *uasc.Message) {
+	if s.Handler == nil {
+		s.logger().Log(LogLevelWarn, "no handler registered", "conn_id", connID, "service", fmt.Sprintf("%T", msg.V))
+		return
+	}
+	w := &ResponseWriter{}
+	r := &Request{Msg: msg, Session: sess}
+	s.Handler.ServeOPCUA(w, r)
+	if w.Msg != nil {
+		sechan.Send(w.Msg)
+	}
+}
+
 func (s *Server) Close() error {
 	return s.l.Close()
 }
 
 type Handler interface {
-	ServeOPCUA(w ResponseWriter, r *Request)
+	ServeOPCUA(w *ResponseWriter, r *Request)
 }
 
-type HandlerFunc func(w ResponseWriter, r *Request)
+type HandlerFunc func(w *ResponseWriter, r *Request)
 
-func (f HandlerFunc) ServeOPCUA(w ResponseWriter, r *Request) {
+func (f HandlerFunc) ServeOPCUA(w *ResponseWriter, r *Request) {
 	f(w, r)
 }
 
 type Request struct {
 	Msg *uasc.Message
+
+	// Session is the activated session the request was received on,
+	// identifying the caller. Requests without an activated session,
+	// and services the Server handles itself (such as FindServers and
+	// GetEndpoints), never reach the Handler.
+	Session *Session
 }
 
 type ResponseWriter struct {
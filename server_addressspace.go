@@ -0,0 +1,94 @@
+// Copyright 2018-2020 opcua authors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+
+package opcua
+
+import (
+	"context"
+	"time"
+
+	"github.com/gopcua/opcua/ua"
+	"github.com/gopcua/opcua/uasc"
+)
+
+// AddressSpace returns the NodeManager this server serves
+// Browse/Read/Write/TranslateBrowsePathsToNodeIds/Call requests from.
+// Register nodes on it before calling ListenAndServe. NewServer builds
+// it eagerly, so concurrent request handlers only ever read the field.
+func (s *Server) AddressSpace() *AddressSpace {
+	return s.addrSpace
+}
+
+func (s *Server) handleBrowse(ctx context.Context, connID uint32, sechan *uasc.SecureChannel, req *ua.BrowseRequest) {
+	s.logRequest(connID, sechan, "handle", req)
+
+	results := make([]*ua.BrowseResult, len(req.NodesToBrowse))
+	for i, desc := range req.NodesToBrowse {
+		refs, status := s.AddressSpace().browse(desc.NodeID)
+		results[i] = &ua.BrowseResult{
+			StatusCode: status,
+			References: refs,
+		}
+	}
+
+	sechan.SendResponse(req, &ua.BrowseResponse{Results: results})
+}
+
+func (s *Server) handleRead(ctx context.Context, connID uint32, sechan *uasc.SecureChannel, req *ua.ReadRequest) {
+	s.logRequest(connID, sechan, "handle", req)
+
+	results := make([]*ua.DataValue, len(req.NodesToRead))
+	for i, rv := range req.NodesToRead {
+		v, status := s.AddressSpace().readAttribute(rv.NodeID, rv.AttributeID)
+		results[i] = &ua.DataValue{
+			Value:           v,
+			Status:          status,
+			SourceTimestamp: time.Now(),
+		}
+	}
+
+	sechan.SendResponse(req, &ua.ReadResponse{Results: results})
+}
+
+func (s *Server) handleWrite(ctx context.Context, connID uint32, sechan *uasc.SecureChannel, req *ua.WriteRequest) {
+	s.logRequest(connID, sechan, "handle", req)
+
+	results := make([]ua.StatusCode, len(req.NodesToWrite))
+	for i, wv := range req.NodesToWrite {
+		results[i] = s.AddressSpace().writeValue(wv.NodeID, wv.AttributeID, wv.Value.Value)
+	}
+
+	sechan.SendResponse(req, &ua.WriteResponse{Results: results})
+}
+
+func (s *Server) handleTranslateBrowsePaths(ctx context.Context, connID uint32, sechan *uasc.SecureChannel, req *ua.TranslateBrowsePathsToNodeIdsRequest) {
+	s.logRequest(connID, sechan, "handle", req)
+
+	results := make([]*ua.BrowsePathResult, len(req.BrowsePaths))
+	for i, bp := range req.BrowsePaths {
+		target, status := s.AddressSpace().translateBrowsePath(bp)
+		result := &ua.BrowsePathResult{StatusCode: status}
+		if status == ua.StatusOK {
+			result.Targets = []*ua.BrowsePathTarget{{TargetID: ua.NewExpandedNodeID(target), RemainingPathIndex: 0xFFFFFFFF}}
+		}
+		results[i] = result
+	}
+
+	sechan.SendResponse(req, &ua.TranslateBrowsePathsToNodeIdsResponse{Results: results})
+}
+
+func (s *Server) handleCall(ctx context.Context, connID uint32, sechan *uasc.SecureChannel, req *ua.CallRequest) {
+	s.logRequest(connID, sechan, "handle", req)
+
+	results := make([]*ua.CallMethodResult, len(req.MethodsToCall))
+	for i, mtc := range req.MethodsToCall {
+		outputs, status := s.AddressSpace().call(mtc.MethodID, mtc.InputArguments)
+		results[i] = &ua.CallMethodResult{
+			StatusCode:      status,
+			OutputArguments: outputs,
+		}
+	}
+
+	sechan.SendResponse(req, &ua.CallResponse{Results: results})
+}
@@ -0,0 +1,207 @@
+// Copyright 2018-2020 opcua authors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+
+package opcua
+
+import (
+	"context"
+	"time"
+
+	"github.com/gopcua/opcua/ua"
+	"github.com/gopcua/opcua/uasc"
+)
+
+// SubscriptionManager returns the manager tracking this server's active
+// Subscriptions. NewServer builds it eagerly, so concurrent request
+// handlers only ever read the field.
+func (s *Server) SubscriptionManager() *SubscriptionManager {
+	return s.subMgr
+}
+
+func (s *Server) handleCreateSubscription(ctx context.Context, connID uint32, sechan *uasc.SecureChannel, req *ua.CreateSubscriptionRequest) {
+	s.logRequest(connID, sechan, "handle", req)
+
+	interval := time.Duration(req.RequestedPublishingInterval) * time.Millisecond
+	sub := s.SubscriptionManager().Create(sechan.AuthenticationToken(), interval, req.RequestedMaxKeepAliveCount, req.RequestedLifetimeCount)
+
+	sechan.SendResponse(req, &ua.CreateSubscriptionResponse{
+		SubscriptionID:            sub.ID,
+		RevisedPublishingInterval: float64(sub.PublishingInterval / time.Millisecond),
+		RevisedLifetimeCount:      sub.LifetimeCount,
+		RevisedMaxKeepAliveCount:  sub.MaxKeepAliveCount,
+	})
+}
+
+func (s *Server) handleModifySubscription(ctx context.Context, connID uint32, sechan *uasc.SecureChannel, req *ua.ModifySubscriptionRequest) {
+	s.logRequest(connID, sechan, "handle", req)
+
+	sub, ok := s.SubscriptionManager().Get(req.SubscriptionID)
+	if !ok {
+		sechan.SendResponse(req, serviceFault(ua.StatusBadSubscriptionIDInvalid))
+		return
+	}
+
+	sub.Modify(time.Duration(req.RequestedPublishingInterval)*time.Millisecond, req.RequestedMaxKeepAliveCount, req.RequestedLifetimeCount)
+
+	sechan.SendResponse(req, &ua.ModifySubscriptionResponse{
+		RevisedPublishingInterval: float64(sub.PublishingInterval / time.Millisecond),
+		RevisedLifetimeCount:      sub.LifetimeCount,
+		RevisedMaxKeepAliveCount:  sub.MaxKeepAliveCount,
+	})
+}
+
+func (s *Server) handleDeleteSubscriptions(ctx context.Context, connID uint32, sechan *uasc.SecureChannel, req *ua.DeleteSubscriptionsRequest) {
+	s.logRequest(connID, sechan, "handle", req)
+
+	results := make([]ua.StatusCode, len(req.SubscriptionIDs))
+	for i, id := range req.SubscriptionIDs {
+		results[i] = s.SubscriptionManager().Delete(id)
+	}
+
+	sechan.SendResponse(req, &ua.DeleteSubscriptionsResponse{Results: results})
+}
+
+func (s *Server) handleSetPublishingMode(ctx context.Context, connID uint32, sechan *uasc.SecureChannel, req *ua.SetPublishingModeRequest) {
+	s.logRequest(connID, sechan, "handle", req)
+
+	results := make([]ua.StatusCode, len(req.SubscriptionIDs))
+	for i, id := range req.SubscriptionIDs {
+		sub, ok := s.SubscriptionManager().Get(id)
+		if !ok {
+			results[i] = ua.StatusBadSubscriptionIDInvalid
+			continue
+		}
+		sub.SetPublishingMode(req.PublishingEnabled)
+		results[i] = ua.StatusOK
+	}
+
+	sechan.SendResponse(req, &ua.SetPublishingModeResponse{Results: results})
+}
+
+func (s *Server) handleCreateMonitoredItems(ctx context.Context, connID uint32, sechan *uasc.SecureChannel, req *ua.CreateMonitoredItemsRequest) {
+	s.logRequest(connID, sechan, "handle", req)
+
+	sub, ok := s.SubscriptionManager().Get(req.SubscriptionID)
+	if !ok {
+		sechan.SendResponse(req, serviceFault(ua.StatusBadSubscriptionIDInvalid))
+		return
+	}
+
+	results := make([]*ua.MonitoredItemCreateResult, len(req.ItemsToCreate))
+	for i, item := range req.ItemsToCreate {
+		interval := time.Duration(item.RequestedParameters.SamplingInterval) * time.Millisecond
+		id := sub.AddMonitoredItem(item.ItemToMonitor.NodeID, item.ItemToMonitor.AttributeID, interval)
+		results[i] = &ua.MonitoredItemCreateResult{
+			StatusCode:              ua.StatusOK,
+			MonitoredItemID:         id,
+			RevisedSamplingInterval: float64(interval / time.Millisecond),
+			RevisedQueueSize:        1,
+		}
+	}
+
+	sechan.SendResponse(req, &ua.CreateMonitoredItemsResponse{Results: results})
+}
+
+func (s *Server) handleModifyMonitoredItems(ctx context.Context, connID uint32, sechan *uasc.SecureChannel, req *ua.ModifyMonitoredItemsRequest) {
+	s.logRequest(connID, sechan, "handle", req)
+
+	sub, ok := s.SubscriptionManager().Get(req.SubscriptionID)
+	if !ok {
+		sechan.SendResponse(req, serviceFault(ua.StatusBadSubscriptionIDInvalid))
+		return
+	}
+
+	results := make([]*ua.MonitoredItemModifyResult, len(req.ItemsToModify))
+	for i, item := range req.ItemsToModify {
+		interval := time.Duration(item.RequestedParameters.SamplingInterval) * time.Millisecond
+		status := sub.ModifyMonitoredItem(item.MonitoredItemID, interval)
+		results[i] = &ua.MonitoredItemModifyResult{
+			StatusCode:              status,
+			RevisedSamplingInterval: float64(interval / time.Millisecond),
+			RevisedQueueSize:        1,
+		}
+	}
+
+	sechan.SendResponse(req, &ua.ModifyMonitoredItemsResponse{Results: results})
+}
+
+func (s *Server) handleDeleteMonitoredItems(ctx context.Context, connID uint32, sechan *uasc.SecureChannel, req *ua.DeleteMonitoredItemsRequest) {
+	s.logRequest(connID, sechan, "handle", req)
+
+	sub, ok := s.SubscriptionManager().Get(req.SubscriptionID)
+	if !ok {
+		sechan.SendResponse(req, serviceFault(ua.StatusBadSubscriptionIDInvalid))
+		return
+	}
+
+	results := make([]ua.StatusCode, len(req.MonitoredItemIDs))
+	for i, id := range req.MonitoredItemIDs {
+		results[i] = sub.DeleteMonitoredItem(id)
+	}
+
+	sechan.SendResponse(req, &ua.DeleteMonitoredItemsResponse{Results: results})
+}
+
+func (s *Server) handlePublish(ctx context.Context, connID uint32, sechan *uasc.SecureChannel, req *ua.PublishRequest, publishDone chan<- publishResult) {
+	s.logRequest(connID, sechan, "handle", req)
+
+	// SubscriptionAcknowledgements only confirm sequence numbers the
+	// client already received; per Part 4 5.13.1 a PublishRequest isn't
+	// bound to the Subscription(s) it acknowledges, so route by session
+	// ownership instead and queue it on the owned Subscription with the
+	// fewest PublishRequests already pending.
+	subs := s.SubscriptionManager().ForOwner(sechan.AuthenticationToken())
+	if len(subs) == 0 {
+		sechan.SendResponse(req, serviceFault(ua.StatusBadNoSubscription))
+		return
+	}
+
+	target := subs[0]
+	for _, sub := range subs[1:] {
+		if sub.pendingCount() < target.pendingCount() {
+			target = sub
+		}
+	}
+
+	ch := make(chan *ua.PublishResponse, 1)
+	if !target.Publish(ch) {
+		sechan.SendResponse(req, serviceFault(ua.StatusBadTooManyPublishRequests))
+		return
+	}
+
+	// A client keeps a PublishRequest outstanding continuously, so
+	// waiting for a notification here must not block handle()'s receive
+	// loop from dispatching the client's other requests. Report the
+	// result on publishDone instead of writing to sechan directly: handle
+	// is the only goroutine allowed to write to a given connection, so
+	// two notifications completing at once can't interleave on the wire.
+	go func() {
+		select {
+		case resp := <-ch:
+			select {
+			case publishDone <- publishResult{req: req, resp: resp}:
+			case <-ctx.Done():
+			}
+		case <-ctx.Done():
+		}
+	}()
+}
+
+func (s *Server) handleRepublish(ctx context.Context, connID uint32, sechan *uasc.SecureChannel, req *ua.RepublishRequest) {
+	s.logRequest(connID, sechan, "handle", req)
+
+	sub, ok := s.SubscriptionManager().Get(req.SubscriptionID)
+	if !ok {
+		sechan.SendResponse(req, serviceFault(ua.StatusBadSubscriptionIDInvalid))
+		return
+	}
+
+	resp, status := sub.Republish(req.RetransmitSequenceNumber)
+	if status != ua.StatusOK {
+		sechan.SendResponse(req, serviceFault(status))
+		return
+	}
+
+	sechan.SendResponse(req, &ua.RepublishResponse{NotificationMessage: resp.NotificationMessage})
+}
@@ -0,0 +1,244 @@
+// Copyright 2018-2020 opcua authors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+
+package opcua
+
+import (
+	"context"
+	"crypto/rand"
+	"time"
+
+	"github.com/gopcua/opcua/ua"
+	"github.com/gopcua/opcua/uasc"
+)
+
+// Session represents a session established between the server and a
+// single client, identified by its AuthenticationToken.
+type Session struct {
+	ID                  *ua.NodeID
+	AuthenticationToken *ua.NodeID
+
+	Timeout time.Duration
+
+	// ClientCertificate and ServerNonce are the values exchanged in
+	// CreateSessionRequest/Response; handleActivateSession verifies
+	// ActivateSessionRequest.ClientSignature against them.
+	ClientCertificate []byte
+	ServerNonce       []byte
+
+	// Activated and Deadline are exported so a Store can persist and
+	// rebuild them across a restart or hand-off to another instance;
+	// see etcdstore.recordToSession.
+	Activated bool
+	Deadline  time.Time
+}
+
+// SessionManager tracks the sessions currently active on a Server and
+// enforces sessionCfg.MaxSessionCount / SessionTimeout. It persists
+// sessions through a Store so they survive a restart, or are visible to
+// other Server instances sharing the same Store.
+type SessionManager struct {
+	store Store
+	max   uint32
+}
+
+// NewSessionManager creates a SessionManager persisting to store and
+// allowing at most max concurrently active sessions. A max of 0 means
+// unlimited.
+func NewSessionManager(max uint32, store Store) *SessionManager {
+	return &SessionManager{
+		store: store,
+		max:   max,
+	}
+}
+
+// Create allocates a new, not-yet-activated Session and registers it
+// under its AuthenticationToken. clientCertificate and serverNonce are
+// the values exchanged in the CreateSessionRequest/Response, kept around
+// for handleActivateSession to verify ClientSignature against.
+func (m *SessionManager) Create(timeout time.Duration, clientCertificate, serverNonce []byte) (*Session, error) {
+	if m.max > 0 {
+		sessions, err := m.store.ListSessions()
+		if err != nil {
+			return nil, err
+		}
+		if uint32(len(sessions)) >= m.max {
+			return nil, ua.StatusBadTooManySessions
+		}
+	}
+
+	token, err := newAuthenticationToken()
+	if err != nil {
+		return nil, err
+	}
+
+	sess := &Session{
+		ID:                  newSessionID(),
+		AuthenticationToken: token,
+		Timeout:             timeout,
+		ClientCertificate:   clientCertificate,
+		ServerNonce:         serverNonce,
+		Deadline:            time.Now().Add(timeout),
+	}
+	if err := m.store.PutSession(token.String(), sess); err != nil {
+		return nil, err
+	}
+	return sess, nil
+}
+
+// Activate marks the session identified by token as activated and
+// refreshes its timeout deadline.
+func (m *SessionManager) Activate(token *ua.NodeID) (*Session, error) {
+	sess, err := m.store.GetSession(token.String())
+	if err != nil {
+		return nil, ua.StatusBadSessionIDInvalid
+	}
+	sess.Activated = true
+	sess.Deadline = time.Now().Add(sess.Timeout)
+	return sess, m.store.PutSession(token.String(), sess)
+}
+
+// Get returns the session registered under token, refreshing its
+// timeout deadline, or ua.StatusBadSessionNotActivated /
+// ua.StatusBadSessionIDInvalid if it cannot be found or used.
+func (m *SessionManager) Get(token *ua.NodeID) (*Session, error) {
+	sess, err := m.store.GetSession(token.String())
+	if err != nil {
+		return nil, ua.StatusBadSessionIDInvalid
+	}
+	if time.Now().After(sess.Deadline) {
+		_ = m.store.DeleteSession(token.String())
+		return nil, ua.StatusBadSessionIDInvalid
+	}
+	if !sess.Activated {
+		return nil, ua.StatusBadSessionNotActivated
+	}
+	sess.Deadline = time.Now().Add(sess.Timeout)
+	return sess, m.store.PutSession(token.String(), sess)
+}
+
+// Close removes the session identified by token, if any.
+func (m *SessionManager) Close(token *ua.NodeID) {
+	_ = m.store.DeleteSession(token.String())
+}
+
+func newAuthenticationToken() (*ua.NodeID, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	return ua.NewByteStringNodeID(1, b), nil
+}
+
+func newSessionID() *ua.NodeID {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return ua.NewByteStringNodeID(1, b)
+}
+
+func (s *Server) handleCreateSession(ctx context.Context, connID uint32, sechan *uasc.SecureChannel, req *ua.CreateSessionRequest) {
+	s.logRequest(connID, sechan, "handle", req)
+
+	serverNonce, err := newServerNonce()
+	if err != nil {
+		sechan.SendResponse(req, serviceFault(ua.StatusBadInternalError))
+		return
+	}
+
+	sess, err := s.sessionMgr.Create(s.sessionCfg.SessionTimeout, req.ClientCertificate, serverNonce)
+	if err != nil {
+		sechan.SendResponse(req, serviceFault(err))
+		return
+	}
+
+	serverSig, err := sechan.SignClientProof(req.ClientCertificate, req.ClientNonce)
+	if err != nil {
+		sechan.SendResponse(req, serviceFault(ua.StatusBadSecurityChecksFailed))
+		return
+	}
+
+	resp := &ua.CreateSessionResponse{
+		SessionID:                  sess.ID,
+		AuthenticationToken:        sess.AuthenticationToken,
+		RevisedSessionTimeout:      float64(sess.Timeout / time.Millisecond),
+		ServerNonce:                serverNonce,
+		ServerEndpoints:            s.endpoints(),
+		ServerSoftwareCertificates: nil,
+		ServerSignature:            serverSig,
+		MaxRequestMessageSize:      0,
+	}
+	sechan.SendResponse(req, resp)
+}
+
+func (s *Server) handleActivateSession(ctx context.Context, connID uint32, sechan *uasc.SecureChannel, req *ua.ActivateSessionRequest) {
+	s.logRequest(connID, sechan, "handle", req)
+
+	token := sechan.AuthenticationToken()
+	sess, err := s.store.GetSession(token.String())
+	if err != nil {
+		sechan.SendResponse(req, serviceFault(ua.StatusBadSessionIDInvalid))
+		return
+	}
+
+	// Part 4, 5.6.3.2: ClientSignature must prove possession of the
+	// private key matching the certificate the client presented at
+	// CreateSession, by signing serverCertificate||serverNonce from that
+	// same exchange. The session is only activated once it does.
+	if err := sechan.VerifyClientSignature(sess.ClientCertificate, s.cfg.Certificate, sess.ServerNonce, req.ClientSignature); err != nil {
+		sechan.SendResponse(req, serviceFault(ua.StatusBadSecurityChecksFailed))
+		return
+	}
+
+	if _, err := s.sessionMgr.Activate(token); err != nil {
+		sechan.SendResponse(req, serviceFault(err))
+		return
+	}
+
+	nonce, err := newServerNonce()
+	if err != nil {
+		sechan.SendResponse(req, serviceFault(ua.StatusBadInternalError))
+		return
+	}
+
+	resp := &ua.ActivateSessionResponse{
+		ServerNonce: nonce,
+	}
+	sechan.SendResponse(req, resp)
+}
+
+// newServerNonce returns a fresh 32-byte random nonce for use in a
+// CreateSessionResponse or ActivateSessionResponse. It must never be derived from data the peer
+// can already predict, such as a NodeID.
+func newServerNonce() ([]byte, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func (s *Server) handleCloseSession(ctx context.Context, connID uint32, sechan *uasc.SecureChannel, req *ua.CloseSessionRequest) {
+	s.logRequest(connID, sechan, "handle", req)
+
+	s.sessionMgr.Close(sechan.AuthenticationToken())
+	sechan.SendResponse(req, &ua.CloseSessionResponse{})
+}
+
+func (s *Server) handleCancel(ctx context.Context, connID uint32, sechan *uasc.SecureChannel, req *ua.CancelRequest) {
+	s.logRequest(connID, sechan, "handle", req)
+
+	// Cancellation of in-flight requests is not tracked per-request yet,
+	// so report that nothing was cancelled rather than pretend to.
+	sechan.SendResponse(req, &ua.CancelResponse{CancelCount: 0})
+}
+
+func serviceFault(err error) *ua.ServiceFault {
+	code, ok := err.(ua.StatusCode)
+	if !ok {
+		code = ua.StatusBadInternalError
+	}
+	return &ua.ServiceFault{
+		ResponseHeader: &ua.ResponseHeader{ServiceResult: code},
+	}
+}
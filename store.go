@@ -0,0 +1,164 @@
+// Copyright 2018-2020 opcua authors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+
+package opcua
+
+import (
+	"sync"
+
+	"github.com/gopcua/opcua/uasc"
+)
+
+// StoreEvent is sent on a Store's Watch channel when a session or
+// subscription changes on another server instance sharing the Store, so
+// that instance can invalidate its local cache.
+type StoreEvent struct {
+	Kind EventKind
+	Key  string
+}
+
+// EventKind identifies what changed in a StoreEvent.
+type EventKind int
+
+const (
+	EventSessionPut EventKind = iota
+	EventSessionDeleted
+	EventSubscriptionPut
+	EventSubscriptionDeleted
+)
+
+// Store persists the state a Server needs to survive a restart or run
+// as one of several instances behind a load balancer: sessions and
+// subscriptions. It has no methods for a subscription's retransmission
+// queue; what of a Subscription is kept is up to the implementation
+// (etcdstore keeps only its publishing parameters). The default, used
+// when no WithStore option is given, is an in-memory MemStore scoped to
+// the current process.
+type Store interface {
+	PutSession(token string, sess *Session) error
+	GetSession(token string) (*Session, error)
+	DeleteSession(token string) error
+	ListSessions() ([]*Session, error)
+
+	PutSubscription(id uint32, sub *Subscription) error
+	GetSubscription(id uint32) (*Subscription, error)
+	DeleteSubscription(id uint32) error
+	ListSubscriptions() ([]*Subscription, error)
+
+	// Watch returns a channel of StoreEvents describing changes made by
+	// other Store instances (e.g. other server processes sharing the
+	// same backend). For a Store whose constructor takes a ctx, such as
+	// etcdstore.New, the channel is closed when that ctx is done.
+	Watch() <-chan StoreEvent
+}
+
+// WithStore sets the Store a Server persists its sessions and
+// subscriptions to. The default is an unshared MemStore.
+func WithStore(st Store) Option {
+	return func(c *uasc.Config, _ *uasc.SessionConfig) {
+		c.Store = st
+	}
+}
+
+// MemStore is the default Store: an in-memory map scoped to the current
+// process. It satisfies Store but never emits Watch events, since there
+// is only ever one instance to invalidate.
+type MemStore struct {
+	mu     sync.RWMutex
+	sess   map[string]*Session
+	subs   map[uint32]*Subscription
+	events chan StoreEvent
+}
+
+// NewMemStore returns an empty MemStore.
+func NewMemStore() *MemStore {
+	return &MemStore{
+		sess:   make(map[string]*Session),
+		subs:   make(map[uint32]*Subscription),
+		events: make(chan StoreEvent),
+	}
+}
+
+func (m *MemStore) PutSession(token string, sess *Session) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sess[token] = sess
+	return nil
+}
+
+func (m *MemStore) GetSession(token string) (*Session, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	sess, ok := m.sess[token]
+	if !ok {
+		return nil, errSessionNotFound
+	}
+	return sess, nil
+}
+
+func (m *MemStore) DeleteSession(token string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.sess, token)
+	return nil
+}
+
+func (m *MemStore) ListSessions() ([]*Session, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	out := make([]*Session, 0, len(m.sess))
+	for _, sess := range m.sess {
+		out = append(out, sess)
+	}
+	return out, nil
+}
+
+func (m *MemStore) PutSubscription(id uint32, sub *Subscription) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.subs[id] = sub
+	return nil
+}
+
+func (m *MemStore) GetSubscription(id uint32) (*Subscription, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	sub, ok := m.subs[id]
+	if !ok {
+		return nil, errSubscriptionNotFound
+	}
+	return sub, nil
+}
+
+func (m *MemStore) DeleteSubscription(id uint32) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.subs, id)
+	return nil
+}
+
+func (m *MemStore) ListSubscriptions() ([]*Subscription, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	out := make([]*Subscription, 0, len(m.subs))
+	for _, sub := range m.subs {
+		out = append(out, sub)
+	}
+	return out, nil
+}
+
+// Watch returns a channel that never receives anything: a single
+// MemStore has no peers to invalidate it.
+func (m *MemStore) Watch() <-chan StoreEvent {
+	return m.events
+}
+
+type storeError string
+
+func (e storeError) Error() string { return string(e) }
+
+const (
+	errSessionNotFound      = storeError("opcua: session not found in store")
+	errSubscriptionNotFound = storeError("opcua: subscription not found in store")
+)
@@ -0,0 +1,452 @@
+// Copyright 2018-2020 opcua authors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+
+package opcua
+
+import (
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/gopcua/opcua/ua"
+)
+
+// maxRetransmitQueueLen bounds how many past PublishResponses a
+// Subscription keeps around to answer RepublishRequest.
+const maxRetransmitQueueLen = 100
+
+// minPublishingInterval floors the interval a client may request: a
+// value <= 0 would otherwise reach time.Ticker.Reset/NewTicker, both of
+// which panic on a non-positive duration.
+const minPublishingInterval = 50 * time.Millisecond
+
+// maxPendingPublish bounds how many outstanding PublishRequests a
+// Subscription will queue. A client that keeps sending them while
+// publishing is disabled (legal, to keep the session alive) would
+// otherwise grow pendingPublish, and the goroutine answering each one,
+// without bound.
+const maxPendingPublish = 10
+
+func clampPublishingInterval(d time.Duration) time.Duration {
+	if d < minPublishingInterval {
+		return minPublishingInterval
+	}
+	return d
+}
+
+// MonitoredItem samples a single node/attribute from an AddressSpace at
+// its own SamplingInterval and feeds MonitoredItemNotifications into its
+// owning Subscription.
+type MonitoredItem struct {
+	ID               uint32
+	NodeID           *ua.NodeID
+	AttributeID      ua.AttributeID
+	SamplingInterval time.Duration
+
+	last       *ua.Variant
+	nextSample time.Time
+}
+
+// due reports whether mi's SamplingInterval has elapsed since it was
+// last sampled. tick() calls this once per PublishingInterval tick, so
+// a SamplingInterval shorter than the owning Subscription's
+// PublishingInterval samples at most once per tick regardless.
+func (mi *MonitoredItem) due(now time.Time) bool {
+	return !now.Before(mi.nextSample)
+}
+
+func (mi *MonitoredItem) sample(as *AddressSpace) *ua.MonitoredItemNotification {
+	mi.nextSample = time.Now().Add(mi.SamplingInterval)
+
+	v, status := as.readAttribute(mi.NodeID, mi.AttributeID)
+	if status != ua.StatusOK {
+		return nil
+	}
+	// Value holds arbitrary dynamic types, including non-comparable ones
+	// such as the NamespaceArray's []string; == would panic on those, so
+	// compare with reflect.DeepEqual instead.
+	if mi.last != nil && reflect.DeepEqual(mi.last.Value, v.Value) {
+		return nil
+	}
+	mi.last = v
+
+	return &ua.MonitoredItemNotification{
+		ClientHandle: mi.ID,
+		Value: &ua.DataValue{
+			Value:           v,
+			Status:          status,
+			SourceTimestamp: time.Now(),
+		},
+	}
+}
+
+// Subscription drives one client's publishing cycle: a goroutine wakes
+// up every PublishingInterval, samples its MonitoredItems, and either
+// completes a PublishRequest the client already queued or holds the
+// notification until one arrives.
+type Subscription struct {
+	ID                uint32
+	PublishingInterval time.Duration
+	MaxKeepAliveCount  uint32
+	LifetimeCount      uint32
+
+	// Owner is the AuthenticationToken of the session that created this
+	// Subscription. handlePublish uses it to find the Subscriptions a
+	// PublishRequest may be serviced by, independent of its
+	// acknowledgements.
+	Owner *ua.NodeID
+
+	as *AddressSpace
+
+	mu             sync.Mutex
+	items          map[uint32]*MonitoredItem
+	nextItemID     uint32
+	nextSeqNum     uint32
+	pendingPublish []chan *ua.PublishResponse
+	pendingNotify  []*ua.PublishResponse
+	retransmit     map[uint32]*ua.PublishResponse
+	keepAlives     uint32
+	publishing     bool
+
+	log      Logger
+	done     chan struct{}
+	modified chan struct{}
+}
+
+// NewSubscription creates a Subscription and starts its publishing
+// goroutine. Call Close to stop it. A nil log uses DefaultLogger.
+func NewSubscription(id uint32, owner *ua.NodeID, as *AddressSpace, publishingInterval time.Duration, maxKeepAliveCount, lifetimeCount uint32, log Logger) *Subscription {
+	if log == nil {
+		log = DefaultLogger
+	}
+	sub := &Subscription{
+		ID:                 id,
+		PublishingInterval: clampPublishingInterval(publishingInterval),
+		MaxKeepAliveCount:  maxKeepAliveCount,
+		LifetimeCount:      lifetimeCount,
+		Owner:              owner,
+		as:                 as,
+		items:              make(map[uint32]*MonitoredItem),
+		retransmit:         make(map[uint32]*ua.PublishResponse),
+		publishing:         true,
+		log:                log,
+		done:               make(chan struct{}),
+		modified:           make(chan struct{}, 1),
+	}
+	go sub.run()
+	return sub
+}
+
+// Modify revises this Subscription's publishing parameters in place, as
+// requested by a ModifySubscriptionRequest.
+func (s *Subscription) Modify(publishingInterval time.Duration, maxKeepAliveCount, lifetimeCount uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.PublishingInterval = clampPublishingInterval(publishingInterval)
+	s.MaxKeepAliveCount = maxKeepAliveCount
+	s.LifetimeCount = lifetimeCount
+}
+
+// ModifyMonitoredItem revises the SamplingInterval of a previously added
+// MonitoredItem, as requested by a ModifyMonitoredItemsRequest.
+func (s *Subscription) ModifyMonitoredItem(id uint32, samplingInterval time.Duration) ua.StatusCode {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	mi, ok := s.items[id]
+	if !ok {
+		return ua.StatusBadMonitoredItemIDInvalid
+	}
+	mi.SamplingInterval = samplingInterval
+	mi.nextSample = time.Time{}
+	return ua.StatusOK
+}
+
+// pendingCount returns how many PublishRequests are already queued
+// against this Subscription, so handlePublish can spread a session's
+// outstanding requests across its Subscriptions.
+func (s *Subscription) pendingCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.pendingPublish)
+}
+
+// AddMonitoredItem registers a MonitoredItem on this Subscription and
+// returns its server-assigned ID.
+func (s *Subscription) AddMonitoredItem(nodeID *ua.NodeID, attrID ua.AttributeID, samplingInterval time.Duration) uint32 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.nextItemID++
+	id := s.nextItemID
+	s.items[id] = &MonitoredItem{
+		ID:               id,
+		NodeID:           nodeID,
+		AttributeID:      attrID,
+		SamplingInterval: samplingInterval,
+	}
+	return id
+}
+
+// DeleteMonitoredItem removes a previously added MonitoredItem.
+func (s *Subscription) DeleteMonitoredItem(id uint32) ua.StatusCode {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.items[id]; !ok {
+		return ua.StatusBadMonitoredItemIDInvalid
+	}
+	delete(s.items, id)
+	return ua.StatusOK
+}
+
+// SetPublishingMode enables or disables the publishing timer without
+// tearing down the Subscription's MonitoredItems.
+func (s *Subscription) SetPublishingMode(enabled bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.publishing = enabled
+}
+
+// Publish completes ch immediately with a notification tick() already
+// produced but had no PublishRequest to deliver it on, or else queues ch
+// to be completed with the Subscription's next notification. It reports
+// false, queuing nothing, if maxPendingPublish requests are already
+// outstanding on this Subscription.
+func (s *Subscription) Publish(ch chan *ua.PublishResponse) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.pendingNotify) > 0 {
+		resp := s.pendingNotify[0]
+		s.pendingNotify = s.pendingNotify[1:]
+		ch <- resp
+		return true
+	}
+	if len(s.pendingPublish) >= maxPendingPublish {
+		return false
+	}
+	s.pendingPublish = append(s.pendingPublish, ch)
+	return true
+}
+
+// Republish returns the PublishResponse previously sent with the given
+// SequenceNumber, for a client that missed it.
+func (s *Subscription) Republish(seqNum uint32) (*ua.PublishResponse, ua.StatusCode) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	resp, ok := s.retransmit[seqNum]
+	if !ok {
+		return nil, ua.StatusBadMessageNotAvailable
+	}
+	return resp, ua.StatusOK
+}
+
+// Close stops the Subscription's publishing goroutine and releases any
+// PublishRequests still queued against it, so the connections waiting on
+// them get an immediate BadNoSubscription instead of hanging until the
+// client gives up or the connection itself closes.
+func (s *Subscription) Close() {
+	close(s.done)
+
+	s.mu.Lock()
+	pending := s.pendingPublish
+	s.pendingPublish = nil
+	s.mu.Unlock()
+
+	for _, ch := range pending {
+		close(ch)
+	}
+}
+
+func (s *Subscription) run() {
+	s.mu.Lock()
+	interval := s.PublishingInterval
+	s.mu.Unlock()
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-t.C:
+			s.tick()
+			s.mu.Lock()
+			if s.PublishingInterval != interval {
+				interval = s.PublishingInterval
+				t.Reset(interval)
+			}
+			s.mu.Unlock()
+		}
+	}
+}
+
+func (s *Subscription) tick() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.publishing {
+		return
+	}
+
+	now := time.Now()
+	var notifications []*ua.MonitoredItemNotification
+	for _, mi := range s.items {
+		if !mi.due(now) {
+			continue
+		}
+		if n := s.sampleItem(mi); n != nil {
+			notifications = append(notifications, n)
+		}
+	}
+
+	if len(notifications) == 0 {
+		s.keepAlives++
+		if s.keepAlives < s.MaxKeepAliveCount {
+			return
+		}
+	}
+	s.keepAlives = 0
+
+	s.nextSeqNum++
+	resp := &ua.PublishResponse{
+		SubscriptionID: s.ID,
+		SequenceNumber: s.nextSeqNum,
+		NotificationMessage: &ua.NotificationMessage{
+			SequenceNumber: s.nextSeqNum,
+			PublishTime:    time.Now(),
+			NotificationData: notifications,
+		},
+		MoreNotifications: false,
+	}
+
+	s.retransmit[s.nextSeqNum] = resp
+	if len(s.retransmit) > maxRetransmitQueueLen {
+		s.evictOldestRetransmitLocked()
+	}
+
+	if len(s.pendingPublish) == 0 {
+		// No PublishRequest is outstanding: hold resp so the next one
+		// delivers it immediately, instead of only relying on Republish
+		// for a SequenceNumber the client was never told about.
+		s.pendingNotify = append(s.pendingNotify, resp)
+		if len(s.pendingNotify) > maxRetransmitQueueLen {
+			s.pendingNotify = s.pendingNotify[1:]
+		}
+		return
+	}
+	ch := s.pendingPublish[0]
+	s.pendingPublish = s.pendingPublish[1:]
+	ch <- resp
+}
+
+// sampleItem wraps mi.sample with a recover so that a misbehaving
+// AttributeID/Value combination cannot take down tick() and silently
+// stop delivering notifications to every other MonitoredItem on this
+// Subscription; the panic is logged rather than swallowed, so the
+// underlying fault is still visible to an operator. Callers must hold
+// s.mu.
+func (s *Subscription) sampleItem(mi *MonitoredItem) (n *ua.MonitoredItemNotification) {
+	defer func() {
+		if r := recover(); r != nil {
+			s.log.Log(LogLevelError, "monitored item sample panicked", "subscription_id", s.ID, "monitored_item_id", mi.ID, "panic", r)
+			n = nil
+		}
+	}()
+	return mi.sample(s.as)
+}
+
+func (s *Subscription) evictOldestRetransmitLocked() {
+	var oldest uint32
+	for seq := range s.retransmit {
+		if oldest == 0 || seq < oldest {
+			oldest = seq
+		}
+	}
+	delete(s.retransmit, oldest)
+}
+
+// SubscriptionManager tracks the Subscriptions created by clients of a
+// Server, keyed by SubscriptionID. Live Subscriptions (with their
+// publishing goroutine and pending PublishRequests) are only ever owned
+// by one Server instance, but their creation and deletion are mirrored
+// into a Store so a failover instance can see what it is taking over.
+// Retransmission state is not written to the Store.
+type SubscriptionManager struct {
+	mu   sync.Mutex
+	subs map[uint32]*Subscription
+
+	as        *AddressSpace
+	store     Store
+	log       Logger
+	nextSubID uint32
+}
+
+// NewSubscriptionManager creates a SubscriptionManager sampling as and
+// mirroring subscription metadata into store. A nil log uses
+// DefaultLogger.
+func NewSubscriptionManager(as *AddressSpace, store Store, log Logger) *SubscriptionManager {
+	if log == nil {
+		log = DefaultLogger
+	}
+	return &SubscriptionManager{
+		subs:  make(map[uint32]*Subscription),
+		as:    as,
+		store: store,
+		log:   log,
+	}
+}
+
+// Create allocates and starts a new Subscription owned by owner.
+func (m *SubscriptionManager) Create(owner *ua.NodeID, publishingInterval time.Duration, maxKeepAliveCount, lifetimeCount uint32) *Subscription {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.nextSubID++
+	sub := NewSubscription(m.nextSubID, owner, m.as, publishingInterval, maxKeepAliveCount, lifetimeCount, m.log)
+	m.subs[sub.ID] = sub
+	_ = m.store.PutSubscription(sub.ID, sub)
+	return sub
+}
+
+// Get returns the Subscription registered under id.
+func (m *SubscriptionManager) Get(id uint32) (*Subscription, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sub, ok := m.subs[id]
+	return sub, ok
+}
+
+// ForOwner returns the Subscriptions created by the session identified
+// by owner, in no particular order. handlePublish uses it to route a
+// PublishRequest independent of its acknowledgements: per Part 4
+// 5.13.1, any Subscription belonging to the session may consume it.
+func (m *SubscriptionManager) ForOwner(owner *ua.NodeID) []*Subscription {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var out []*Subscription
+	for _, sub := range m.subs {
+		if sub.Owner != nil && owner != nil && sub.Owner.String() == owner.String() {
+			out = append(out, sub)
+		}
+	}
+	return out
+}
+
+// Delete stops and removes the Subscription registered under id.
+func (m *SubscriptionManager) Delete(id uint32) ua.StatusCode {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	sub, ok := m.subs[id]
+	if !ok {
+		return ua.StatusBadSubscriptionIDInvalid
+	}
+	sub.Close()
+	delete(m.subs, id)
+	_ = m.store.DeleteSubscription(id)
+	return ua.StatusOK
+}
@@ -0,0 +1,299 @@
+// Copyright 2018-2020 opcua authors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+
+package uasc
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"fmt"
+
+	"github.com/gopcua/opcua/ua"
+)
+
+// Asymmetric signature algorithm URIs used to prove possession of the
+// private key matching a certificate exchanged during the secure-channel
+// handshake; carried in ua.SignatureData.Algorithm.
+const (
+	asymmetricSignatureRsaSha256    = "http://www.w3.org/2001/04/xmldsig-more#rsa-sha256"
+	asymmetricSignatureRsaPssSha256 = "http://opcfoundation.org/UA/security/rsa-pss-sha2-256"
+)
+
+// Security policy URIs supported by the server-side EncryptionHandler.
+const (
+	SecurityPolicyURINone                = "http://opcfoundation.org/UA/SecurityPolicy#None"
+	SecurityPolicyURIBasic256Sha256      = "http://opcfoundation.org/UA/SecurityPolicy#Basic256Sha256"
+	SecurityPolicyURIAes128Sha256RsaOaep = "http://opcfoundation.org/UA/SecurityPolicy#Aes128_Sha256_RsaOaep"
+	SecurityPolicyURIAes256Sha256RsaPss  = "http://opcfoundation.org/UA/SecurityPolicy#Aes256_Sha256_RsaPss"
+)
+
+// EncryptionHandler signs and/or encrypts outgoing chunks and verifies
+// and/or decrypts incoming ones for a single SecurityPolicy, on behalf
+// of a server-side SecureChannel.
+type EncryptionHandler interface {
+	// PolicyURI is the SecurityPolicy this handler implements.
+	PolicyURI() string
+
+	// DeriveKeys derives the symmetric signing/encryption keys for this
+	// channel from the client and server nonces exchanged in
+	// OpenSecureChannelRequest/Response, per the P_SHA256 KDF.
+	DeriveKeys(clientNonce, serverNonce []byte) error
+
+	// Secure signs, and for SecurityModeSignAndEncrypt encrypts, the
+	// given chunk body and returns the result.
+	Secure(mode ua.MessageSecurityMode, chunk []byte) ([]byte, error)
+
+	// Unsecure verifies, and for SecurityModeSignAndEncrypt decrypts,
+	// the given chunk body and returns it without its signature.
+	Unsecure(mode ua.MessageSecurityMode, chunk []byte) ([]byte, error)
+
+	// AsymmetricSign signs data with the server's private key, using
+	// this policy's asymmetric signature algorithm. It is used once, to
+	// produce the ServerSignature returned from CreateSessionResponse,
+	// proving that this channel terminates at the holder of the private
+	// key matching the certificate presented in the handshake.
+	AsymmetricSign(data []byte) ([]byte, error)
+
+	// AsymmetricSignatureAlgorithm returns the URI of the algorithm
+	// AsymmetricSign signs with, for ua.SignatureData.Algorithm.
+	AsymmetricSignatureAlgorithm() string
+
+	// AsymmetricVerify checks that sig is data signed by clientKey,
+	// using this policy's asymmetric signature algorithm. It is used to
+	// verify the ClientSignature sent in ActivateSessionRequest.
+	AsymmetricVerify(clientKey *rsa.PublicKey, data, sig []byte) error
+}
+
+// NewEncryptionHandler returns the EncryptionHandler for policyURI, using
+// cert/key as the server's own certificate and private key. It returns
+// an error for unsupported policy URIs.
+func NewEncryptionHandler(policyURI string, cert *x509.Certificate, key *rsa.PrivateKey) (EncryptionHandler, error) {
+	switch policyURI {
+	case SecurityPolicyURIBasic256Sha256, SecurityPolicyURIAes128Sha256RsaOaep, SecurityPolicyURIAes256Sha256RsaPss:
+		return &sha256EncryptionHandler{
+			policyURI: policyURI,
+			cert:      cert,
+			key:       key,
+		}, nil
+	default:
+		return nil, fmt.Errorf("uasc: unsupported security policy %q", policyURI)
+	}
+}
+
+// sha256EncryptionHandler implements EncryptionHandler for the policies
+// that derive their symmetric keys with the P_SHA256 KDF: Basic256Sha256,
+// Aes128_Sha256_RsaOaep, and Aes256_Sha256_RsaPss.
+type sha256EncryptionHandler struct {
+	policyURI string
+	cert      *x509.Certificate
+	key       *rsa.PrivateKey
+
+	// clientKeys secure chunks the client sends, so this server unseals
+	// incoming chunks with them. serverKeys secure chunks this server
+	// sends, so outgoing chunks are sealed with them. OPC UA Part 6,
+	// 6.7.5 derives the two independently; reusing one set for both
+	// directions does not interoperate with a conforming client.
+	clientKeys keyMaterial
+	serverKeys keyMaterial
+}
+
+// keyMaterial is one direction's signing key, encrypting key, and IV, as
+// derived by pSHA256.
+type keyMaterial struct {
+	signingKey    []byte
+	encryptingKey []byte
+	iv            []byte
+}
+
+func (h *sha256EncryptionHandler) PolicyURI() string { return h.policyURI }
+
+// keySizes returns the signing key, encrypting key, and block size for
+// this handler's policy, in bytes. Basic256Sha256 and Aes256_Sha256_RsaPss
+// both mandate a 256-bit (32-byte) encrypting key; only
+// Aes128_Sha256_RsaOaep uses a 128-bit (16-byte) one.
+func (h *sha256EncryptionHandler) keySizes() (signing, encrypting, blockSize int) {
+	if h.policyURI == SecurityPolicyURIAes128Sha256RsaOaep {
+		return 32, 16, aes.BlockSize
+	}
+	return 32, 32, aes.BlockSize
+}
+
+func (h *sha256EncryptionHandler) DeriveKeys(clientNonce, serverNonce []byte) error {
+	signingLen, encryptingLen, ivLen := h.keySizes()
+
+	// Part 6, 6.7.5: the client's keys are derived with the server's
+	// nonce as secret and the client's as seed; the server's keys swap
+	// secret and seed.
+	h.clientKeys = deriveKeyMaterial(serverNonce, clientNonce, signingLen, encryptingLen, ivLen)
+	h.serverKeys = deriveKeyMaterial(clientNonce, serverNonce, signingLen, encryptingLen, ivLen)
+	return nil
+}
+
+func deriveKeyMaterial(secret, seed []byte, signingLen, encryptingLen, ivLen int) keyMaterial {
+	material := pSHA256(secret, seed, signingLen+encryptingLen+ivLen)
+	return keyMaterial{
+		signingKey:    material[:signingLen],
+		encryptingKey: material[signingLen : signingLen+encryptingLen],
+		iv:            material[signingLen+encryptingLen:],
+	}
+}
+
+func (h *sha256EncryptionHandler) Secure(mode ua.MessageSecurityMode, chunk []byte) ([]byte, error) {
+	if mode == ua.MessageSecurityModeNone {
+		return chunk, nil
+	}
+
+	signed := append(chunk, sign(h.serverKeys, chunk)...)
+	if mode == ua.MessageSecurityModeSign {
+		return signed, nil
+	}
+	return encrypt(h.serverKeys, signed)
+}
+
+func (h *sha256EncryptionHandler) Unsecure(mode ua.MessageSecurityMode, chunk []byte) ([]byte, error) {
+	if mode == ua.MessageSecurityModeNone {
+		return chunk, nil
+	}
+
+	plain := chunk
+	if mode == ua.MessageSecurityModeSignAndEncrypt {
+		dec, err := decrypt(h.clientKeys, chunk)
+		if err != nil {
+			return nil, err
+		}
+		plain = dec
+	}
+
+	sigLen := sha256.Size
+	if len(plain) < sigLen {
+		return nil, ua.StatusBadSecurityChecksFailed
+	}
+	body, sig := plain[:len(plain)-sigLen], plain[len(plain)-sigLen:]
+	if !hmac.Equal(sig, sign(h.clientKeys, body)) {
+		return nil, ua.StatusBadSecurityChecksFailed
+	}
+	return body, nil
+}
+
+// pssOptions matches the salt length the OPC UA RsaPss SecurityPolicies
+// mandate: equal to the hash's output size, not crypto/rsa's default
+// auto-detected maximum.
+var pssOptions = &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: crypto.SHA256}
+
+func (h *sha256EncryptionHandler) AsymmetricSign(data []byte) ([]byte, error) {
+	if h.key == nil {
+		return nil, fmt.Errorf("uasc: no private key configured for policy %q", h.policyURI)
+	}
+	hashed := sha256.Sum256(data)
+	if h.policyURI == SecurityPolicyURIAes256Sha256RsaPss {
+		return rsa.SignPSS(rand.Reader, h.key, crypto.SHA256, hashed[:], pssOptions)
+	}
+	return rsa.SignPKCS1v15(rand.Reader, h.key, crypto.SHA256, hashed[:])
+}
+
+func (h *sha256EncryptionHandler) AsymmetricSignatureAlgorithm() string {
+	if h.policyURI == SecurityPolicyURIAes256Sha256RsaPss {
+		return asymmetricSignatureRsaPssSha256
+	}
+	return asymmetricSignatureRsaSha256
+}
+
+func (h *sha256EncryptionHandler) AsymmetricVerify(clientKey *rsa.PublicKey, data, sig []byte) error {
+	hashed := sha256.Sum256(data)
+	var err error
+	if h.policyURI == SecurityPolicyURIAes256Sha256RsaPss {
+		err = rsa.VerifyPSS(clientKey, crypto.SHA256, hashed[:], sig, pssOptions)
+	} else {
+		err = rsa.VerifyPKCS1v15(clientKey, crypto.SHA256, hashed[:], sig)
+	}
+	if err != nil {
+		return ua.StatusBadSecurityChecksFailed
+	}
+	return nil
+}
+
+func sign(keys keyMaterial, b []byte) []byte {
+	mac := hmac.New(sha256.New, keys.signingKey)
+	mac.Write(b)
+	return mac.Sum(nil)
+}
+
+func encrypt(keys keyMaterial, plain []byte) ([]byte, error) {
+	block, err := aes.NewCipher(keys.encryptingKey)
+	if err != nil {
+		return nil, err
+	}
+	padded := pkcs7Pad(plain, block.BlockSize())
+	out := make([]byte, len(padded))
+	cipher.NewCBCEncrypter(block, keys.iv).CryptBlocks(out, padded)
+	return out, nil
+}
+
+func decrypt(keys keyMaterial, enc []byte) ([]byte, error) {
+	block, err := aes.NewCipher(keys.encryptingKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(enc)%block.BlockSize() != 0 {
+		return nil, ua.StatusBadSecurityChecksFailed
+	}
+	out := make([]byte, len(enc))
+	cipher.NewCBCDecrypter(block, keys.iv).CryptBlocks(out, enc)
+	return pkcs7Unpad(out)
+}
+
+// pSHA256 implements the P_SHA256 pseudo-random function used by the
+// OPC UA SecurityPolicies to derive keying material from a secret and
+// seed, per OPC UA Part 6, 6.2.4.
+func pSHA256(secret, seed []byte, length int) []byte {
+	var out []byte
+	a := hmacSHA256(secret, seed)
+	for len(out) < length {
+		out = append(out, hmacSHA256(secret, append(a, seed...))...)
+		a = hmacSHA256(secret, a)
+	}
+	return out[:length]
+}
+
+func hmacSHA256(key, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+func pkcs7Pad(b []byte, blockSize int) []byte {
+	n := blockSize - len(b)%blockSize
+	pad := make([]byte, n)
+	for i := range pad {
+		pad[i] = byte(n)
+	}
+	return append(b, pad...)
+}
+
+func pkcs7Unpad(b []byte) ([]byte, error) {
+	if len(b) == 0 {
+		return nil, ua.StatusBadSecurityChecksFailed
+	}
+	n := int(b[len(b)-1])
+	if n == 0 || n > len(b) {
+		return nil, ua.StatusBadSecurityChecksFailed
+	}
+	return b[:len(b)-n], nil
+}
+
+// newNonce returns a cryptographically random nonce of the given length,
+// suitable for use in OpenSecureChannelRequest/Response.
+func newNonce(n int) ([]byte, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
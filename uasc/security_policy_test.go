@@ -0,0 +1,157 @@
+// Copyright 2018-2020 opcua authors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+
+package uasc
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"testing"
+
+	"github.com/gopcua/opcua/ua"
+)
+
+// testRSAKey returns a throwaway RSA key for signature tests. 2048 bits
+// is the minimum OPC UA mandates for these policies.
+func testRSAKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generate test RSA key: %v", err)
+	}
+	return key
+}
+
+// TestPSHA256 checks pSHA256 against an independent, spec-literal
+// computation of the P_SHA256 PRF (OPC UA Part 6, 6.2.4):
+// P_SHA256(secret, seed) = HMAC(secret, A(1) + seed) + HMAC(secret, A(2) + seed) + ...,
+// where A(0) = seed and A(i) = HMAC(secret, A(i-1)).
+func TestPSHA256(t *testing.T) {
+	secret := []byte("the-secret-nonce-material")
+	seed := []byte("the-seed-nonce-material")
+
+	mac := func(key, data []byte) []byte {
+		h := hmac.New(sha256.New, key)
+		h.Write(data)
+		return h.Sum(nil)
+	}
+
+	a1 := mac(secret, seed)
+	a2 := mac(secret, a1)
+	a3 := mac(secret, a2)
+	want := append(mac(secret, append(append([]byte{}, a1...), seed...)), mac(secret, append(append([]byte{}, a2...), seed...))...)
+	want = append(want, mac(secret, append(append([]byte{}, a3...), seed...))...)
+
+	for _, length := range []int{10, sha256.Size, sha256.Size*2 + 7} {
+		got := pSHA256(secret, seed, length)
+		if !bytes.Equal(got, want[:length]) {
+			t.Errorf("pSHA256(len=%d) = %x, want %x", length, got, want[:length])
+		}
+	}
+}
+
+// TestSha256EncryptionHandlerSecureUnsecureRoundTrip checks that a chunk
+// one peer's handler Secures is recovered by Unsecure on the peer at the
+// other end of the channel, for both SecurityModeSign and
+// SecurityModeSignAndEncrypt, across every policy this handler
+// implements. DeriveKeys derives directional key sets (Part 6, 6.7.5),
+// so the two peers are modeled as two handlers with the client/server
+// nonces swapped, matching how the real client and server derive keys
+// from the same nonce pair.
+func TestSha256EncryptionHandlerSecureUnsecureRoundTrip(t *testing.T) {
+	for _, policyURI := range []string{
+		SecurityPolicyURIBasic256Sha256,
+		SecurityPolicyURIAes128Sha256RsaOaep,
+		SecurityPolicyURIAes256Sha256RsaPss,
+	} {
+		for _, mode := range []ua.MessageSecurityMode{ua.MessageSecurityModeSign, ua.MessageSecurityModeSignAndEncrypt} {
+			clientNonce := []byte("client-nonce-012345678901234567")
+			serverNonce := []byte("server-nonce-012345678901234567")
+
+			peerA, err := NewEncryptionHandler(policyURI, nil, nil)
+			if err != nil {
+				t.Fatalf("%s: NewEncryptionHandler: %v", policyURI, err)
+			}
+			if err := peerA.DeriveKeys(clientNonce, serverNonce); err != nil {
+				t.Fatalf("%s: DeriveKeys: %v", policyURI, err)
+			}
+
+			peerB, err := NewEncryptionHandler(policyURI, nil, nil)
+			if err != nil {
+				t.Fatalf("%s: NewEncryptionHandler: %v", policyURI, err)
+			}
+			if err := peerB.DeriveKeys(serverNonce, clientNonce); err != nil {
+				t.Fatalf("%s: DeriveKeys: %v", policyURI, err)
+			}
+
+			chunk := []byte("hello, secure channel")
+			secured, err := peerA.Secure(mode, append([]byte{}, chunk...))
+			if err != nil {
+				t.Fatalf("%s/%v: Secure: %v", policyURI, mode, err)
+			}
+			got, err := peerB.Unsecure(mode, secured)
+			if err != nil {
+				t.Fatalf("%s/%v: Unsecure: %v", policyURI, mode, err)
+			}
+			if !bytes.Equal(got, chunk) {
+				t.Errorf("%s/%v: round trip = %q, want %q", policyURI, mode, got, chunk)
+			}
+		}
+	}
+}
+
+// TestSha256EncryptionHandlerDeriveKeysDirectional checks that DeriveKeys
+// derives distinct key material for the client and server directions;
+// reusing one set for both lets chunks a conforming client signs with
+// its own keys fail server-side verification, and vice versa.
+func TestSha256EncryptionHandlerDeriveKeysDirectional(t *testing.T) {
+	h, err := NewEncryptionHandler(SecurityPolicyURIBasic256Sha256, nil, nil)
+	if err != nil {
+		t.Fatalf("NewEncryptionHandler: %v", err)
+	}
+	hh := h.(*sha256EncryptionHandler)
+	if err := hh.DeriveKeys([]byte("client-nonce-012345678901234567"), []byte("server-nonce-012345678901234567")); err != nil {
+		t.Fatalf("DeriveKeys: %v", err)
+	}
+	if bytes.Equal(hh.clientKeys.signingKey, hh.serverKeys.signingKey) {
+		t.Error("client and server signing keys must differ")
+	}
+	if bytes.Equal(hh.clientKeys.encryptingKey, hh.serverKeys.encryptingKey) {
+		t.Error("client and server encrypting keys must differ")
+	}
+}
+
+// TestSha256EncryptionHandlerAsymmetricSignVerify checks that
+// AsymmetricVerify accepts a signature produced by AsymmetricSign, and
+// rejects it when checked against different data, for every policy this
+// handler implements.
+func TestSha256EncryptionHandlerAsymmetricSignVerify(t *testing.T) {
+	key := testRSAKey(t)
+
+	for _, policyURI := range []string{
+		SecurityPolicyURIBasic256Sha256,
+		SecurityPolicyURIAes128Sha256RsaOaep,
+		SecurityPolicyURIAes256Sha256RsaPss,
+	} {
+		h, err := NewEncryptionHandler(policyURI, nil, key)
+		if err != nil {
+			t.Fatalf("%s: NewEncryptionHandler: %v", policyURI, err)
+		}
+
+		data := []byte("client-certificate || server-nonce")
+		sig, err := h.AsymmetricSign(data)
+		if err != nil {
+			t.Fatalf("%s: AsymmetricSign: %v", policyURI, err)
+		}
+		if err := h.AsymmetricVerify(&key.PublicKey, data, sig); err != nil {
+			t.Errorf("%s: AsymmetricVerify rejected a valid signature: %v", policyURI, err)
+		}
+		if err := h.AsymmetricVerify(&key.PublicKey, []byte("tampered"), sig); err == nil {
+			t.Errorf("%s: AsymmetricVerify accepted a signature over the wrong data", policyURI)
+		}
+	}
+}
@@ -0,0 +1,191 @@
+// Copyright 2018-2020 opcua authors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+
+package uasc
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"fmt"
+	"net"
+
+	"github.com/gopcua/opcua/ua"
+)
+
+// NewServerSecureChannel terminates the secure-channel handshake for an
+// inbound connection: it reads the client's OpenSecureChannelRequest,
+// verifies the client certificate (when the requested SecurityMode is not
+// None) against cfg.TrustedCertificates, selects the
+// matching EncryptionHandler, derives the symmetric keys from the
+// client/server nonces, and replies with OpenSecureChannelResponse.
+//
+// It does not itself produce the ServerSignature OPC UA Part 4, 5.6.2
+// requires for CreateSessionResponse: that signature is computed over
+// the ClientCertificate/ClientNonce of the CreateSessionRequest, which
+// is sent later and may differ per session on a shared channel. See
+// SignClientProof, which handleCreateSession calls instead.
+//
+// cfg.Certificate, cfg.PrivateKey, cfg.TrustedCertificates, and
+// cfg.EnabledSecurityPolicies configure the handshake; see
+// opcua.WithServerCertificate and friends.
+func NewServerSecureChannel(endpoint string, c net.Conn, cfg *Config) (*SecureChannel, error) {
+	sc, err := NewSecureChannel(endpoint, c, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	req, policyURI, err := sc.readOpenSecureChannelRequest()
+	if err != nil {
+		return nil, err
+	}
+
+	if !policyEnabled(policyURI, cfg.EnabledSecurityPolicies) {
+		return nil, fmt.Errorf("uasc: security policy %q not enabled on this server", policyURI)
+	}
+
+	if req.SecurityMode != ua.MessageSecurityModeNone {
+		if err := verifyClientCertificate(req, cfg.TrustedCertificates); err != nil {
+			return nil, err
+		}
+	}
+
+	var serverCert *x509.Certificate
+	if len(cfg.Certificate) > 0 {
+		serverCert, err = x509.ParseCertificate(cfg.Certificate)
+		if err != nil {
+			return nil, fmt.Errorf("uasc: parse server certificate: %w", err)
+		}
+	}
+
+	serverNonce, err := newNonce(32)
+	if err != nil {
+		return nil, err
+	}
+
+	// SecurityPolicy#None has no keys to derive: sc.enc stays nil, which
+	// SignClientProof, VerifyClientSignature, RenewToken and Renew accept.
+	var enc EncryptionHandler
+	if policyURI != SecurityPolicyURINone {
+		enc, err = NewEncryptionHandler(policyURI, serverCert, cfg.PrivateKey)
+		if err != nil {
+			return nil, err
+		}
+		if err := enc.DeriveKeys(req.ClientNonce, serverNonce); err != nil {
+			return nil, err
+		}
+	}
+
+	sc.enc = enc
+	sc.securityMode = req.SecurityMode
+
+	if err := sc.writeOpenSecureChannelResponse(req, cfg.Certificate, serverNonce); err != nil {
+		return nil, err
+	}
+	return sc, nil
+}
+
+// SignClientProof signs clientCertificate||clientNonce from a
+// CreateSessionRequest with the server's private key, for use as the
+// ServerSignature in CreateSessionResponse (OPC UA Part 4, 5.6.2). It
+// returns nil, nil for a channel opened with SecurityMode#None, which
+// has no certificate to sign against.
+func (sc *SecureChannel) SignClientProof(clientCertificate, clientNonce []byte) (*ua.SignatureData, error) {
+	if sc.enc == nil || sc.securityMode == ua.MessageSecurityModeNone {
+		return nil, nil
+	}
+	proof := append(append([]byte{}, clientCertificate...), clientNonce...)
+	sig, err := sc.enc.AsymmetricSign(proof)
+	if err != nil {
+		return nil, err
+	}
+	return &ua.SignatureData{
+		Algorithm: sc.enc.AsymmetricSignatureAlgorithm(),
+		Signature: sig,
+	}, nil
+}
+
+// VerifyClientSignature checks sig, the ClientSignature of an
+// ActivateSessionRequest, against serverCertificate||serverNonce from
+// the CreateSessionRequest/Response that opened the session (OPC UA
+// Part 4, 5.6.3.2), using the public key from clientCertificate. It
+// returns nil for a channel opened with SecurityMode#None, which has no
+// certificate to verify against.
+func (sc *SecureChannel) VerifyClientSignature(clientCertificate, serverCertificate, serverNonce []byte, sig *ua.SignatureData) error {
+	if sc.enc == nil || sc.securityMode == ua.MessageSecurityModeNone {
+		return nil
+	}
+	if sig == nil {
+		return ua.StatusBadSecurityChecksFailed
+	}
+	cert, err := x509.ParseCertificate(clientCertificate)
+	if err != nil {
+		return ua.StatusBadCertificateInvalid
+	}
+	pub, ok := cert.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return ua.StatusBadCertificateInvalid
+	}
+	proof := append(append([]byte{}, serverCertificate...), serverNonce...)
+	return sc.enc.AsymmetricVerify(pub, proof, sig.Signature)
+}
+
+// RenewToken re-derives the SecureChannel's symmetric keys from fresh
+// nonces for a renewal OpenSecureChannelRequest, without tearing down the
+// underlying uacp connection. It does not issue the new SecurityToken;
+// Renew does that.
+func (sc *SecureChannel) RenewToken(clientNonce, serverNonce []byte) error {
+	if sc.enc == nil {
+		return nil
+	}
+	return sc.enc.DeriveKeys(clientNonce, serverNonce)
+}
+
+// Renew services a renewal OpenSecureChannelRequest on an
+// already-established channel: it derives fresh symmetric keys from a
+// new server nonce and issues a new SecurityToken, without repeating
+// the asymmetric step (the certificates were already exchanged and
+// verified when the channel was opened). On a SecurityPolicy#None channel
+// there are no keys, so only the new SecurityToken is issued.
+func (sc *SecureChannel) Renew(req *ua.OpenSecureChannelRequest, serverCert []byte) error {
+	if sc.enc == nil && sc.securityMode != ua.MessageSecurityModeNone {
+		return fmt.Errorf("uasc: cannot renew a channel that was never opened")
+	}
+	if req.RequestType != ua.SecurityTokenRequestTypeRenew {
+		return fmt.Errorf("uasc: OpenSecureChannelRequest on an open channel must be a renewal, got RequestType %v", req.RequestType)
+	}
+
+	serverNonce, err := newNonce(32)
+	if err != nil {
+		return err
+	}
+	if err := sc.RenewToken(req.ClientNonce, serverNonce); err != nil {
+		return err
+	}
+	return sc.writeOpenSecureChannelResponse(req, serverCert, serverNonce)
+}
+
+func policyEnabled(uri string, enabled []string) bool {
+	for _, e := range enabled {
+		if e == uri {
+			return true
+		}
+	}
+	return false
+}
+
+func verifyClientCertificate(req *ua.OpenSecureChannelRequest, trusted []*x509.Certificate) error {
+	if len(trusted) == 0 {
+		return ua.StatusBadSecurityChecksFailed
+	}
+	cert, err := x509.ParseCertificate(req.ClientCertificate)
+	if err != nil {
+		return ua.StatusBadCertificateInvalid
+	}
+	for _, t := range trusted {
+		if t.Equal(cert) {
+			return nil
+		}
+	}
+	return ua.StatusBadCertificateUntrusted
+}
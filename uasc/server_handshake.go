@@ -0,0 +1,41 @@
+// Copyright 2018-2020 opcua authors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+
+package uasc
+
+import (
+	"github.com/gopcua/opcua/ua"
+)
+
+// readOpenSecureChannelRequest reads the first message of a new secure
+// channel, which must be an OpenSecureChannelRequest, and returns it
+// along with the SecurityPolicyURI carried in its asymmetric security
+// header.
+func (sc *SecureChannel) readOpenSecureChannelRequest() (*ua.OpenSecureChannelRequest, string, error) {
+	msg := sc.Receive(nil)
+	if msg.Err != nil {
+		return nil, "", msg.Err
+	}
+	req, ok := msg.V.(*ua.OpenSecureChannelRequest)
+	if !ok {
+		return nil, "", ua.StatusBadSecurityPolicyRejected
+	}
+	return req, sc.PeerSecurityPolicyURI(), nil
+}
+
+// writeOpenSecureChannelResponse replies to req with a new SecurityToken
+// and serverNonce. serverCert is not written into the response.
+func (sc *SecureChannel) writeOpenSecureChannelResponse(req *ua.OpenSecureChannelRequest, serverCert, serverNonce []byte) error {
+	resp := &ua.OpenSecureChannelResponse{
+		SecurityToken: &ua.ChannelSecurityToken{
+			ChannelID:       sc.ID(),
+			TokenID:         sc.nextTokenID(),
+			CreatedAt:       req.RequestHeader.Timestamp,
+			RevisedLifetime: req.RequestedLifetime,
+		},
+		ServerNonce: serverNonce,
+	}
+	sc.SendResponse(req, resp)
+	return nil
+}
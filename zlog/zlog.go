@@ -0,0 +1,52 @@
+// Copyright 2018-2020 opcua authors. All rights reserved.
+// Use of this source code is governed by a MIT-style license that can be
+// found in the LICENSE file.
+
+// Package zlog adapts github.com/rs/zerolog to the opcua.Logger
+// interface, for callers who want structured output without writing
+// their own adapter.
+package zlog
+
+import (
+	"github.com/rs/zerolog"
+
+	"github.com/gopcua/opcua"
+)
+
+// Logger wraps a zerolog.Logger to satisfy opcua.Logger.
+type Logger struct {
+	log zerolog.Logger
+}
+
+// New returns a Logger that writes through log.
+func New(log zerolog.Logger) *Logger {
+	return &Logger{log: log}
+}
+
+// Log implements opcua.Logger.
+func (l *Logger) Log(level opcua.LogLevel, msg string, kv ...interface{}) {
+	event := l.event(level)
+	for i := 0; i+1 < len(kv); i += 2 {
+		key, ok := kv[i].(string)
+		if !ok {
+			continue
+		}
+		event = event.Interface(key, kv[i+1])
+	}
+	event.Msg(msg)
+}
+
+func (l *Logger) event(level opcua.LogLevel) *zerolog.Event {
+	switch level {
+	case opcua.LogLevelDebug:
+		return l.log.Debug()
+	case opcua.LogLevelInfo:
+		return l.log.Info()
+	case opcua.LogLevelWarn:
+		return l.log.Warn()
+	case opcua.LogLevelError:
+		return l.log.Error()
+	default:
+		return l.log.Info()
+	}
+}